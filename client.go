@@ -4,7 +4,6 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/bgentry/speakeasy"
@@ -31,7 +30,7 @@ func mustClient() *clientv3.Client {
 		if !globals.insecureDiscovery {
 			for i := 0; i < len(eps); {
 				if strings.HasPrefix("http://", eps[i]) {
-					fmt.Fprintf(os.Stderr, "ignoring discovered insecure endpoint %q\n", eps[i])
+					log.warn("ignoring discovered insecure endpoint", "endpoint", eps[i])
 					copy(eps[i:], eps[i+1:])
 					eps = eps[:len(eps)-1]
 				} else {
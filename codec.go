@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+)
+
+// compressed values start with a zero byte, followed by the codec marker and the codec id; snappy is
+// the legacy codec, snappy-encoded values are stored without a header (snappy-encoded empty content is
+// a single zero byte, and non-empty content never starts with one)
+const codecMagic = "\x00C"
+
+// put --compression values
+const (
+	compressionAuto   = "auto"
+	compressionNone   = "none"
+	compressionSnappy = "snappy"
+	compressionGzip   = "gzip"
+	compressionZstd   = "zstd"
+)
+
+const (
+	// with --compression=auto, files smaller than that are stored uncompressed
+	compressMinSize = 256
+	// stored content is not decompressed beyond that, unless its size is known
+	maxContentSize = 64 << 20
+)
+
+var putCompression string
+
+// codec compresses stored values, id is stored in the value header; decode fails if the content
+// exceeds the limit
+type codec struct {
+	id     byte
+	name   string
+	encode func([]byte) ([]byte, error)
+	decode func(data []byte, limit int64) ([]byte, error)
+}
+
+var codecs = []*codec{
+	{id: 'n', name: compressionNone, encode: noneEncode, decode: noneDecode},
+	{id: 'g', name: compressionGzip, encode: gzipEncode, decode: gzipDecode},
+	{id: 'z', name: compressionZstd, encode: zstdEncode, decode: zstdDecode},
+}
+
+var errContentTooLarge = errors.New("content exceeds its size limit")
+
+// zstd encoder and decoder run worker goroutines, so they are only created once used
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxContentSize))
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+func zstdEncode(b []byte) ([]byte, error) {
+	enc, _, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(b, nil), nil
+}
+
+func zstdDecode(b []byte, limit int64) ([]byte, error) {
+	_, dec, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	data, err := dec.DecodeAll(b, nil)
+	if err == zstd.ErrDecoderSizeExceeded || err == nil && int64(len(data)) > limit {
+		return nil, errContentTooLarge
+	}
+	return data, err
+}
+
+func noneEncode(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func noneDecode(b []byte, limit int64) ([]byte, error) {
+	if int64(len(b)) > limit {
+		return nil, errContentTooLarge
+	}
+	return b, nil
+}
+
+func findCodec(name string) *codec {
+	for _, c := range codecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func gzipEncode(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	} else if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipDecode(b []byte, limit int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err == nil && int64(len(data)) > limit {
+		return nil, errContentTooLarge
+	}
+	return data, err
+}
+
+func addCompressionFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&putCompression, "compression", compressionAuto, "file content compression `codec`: none, snappy, gzip, zstd or auto (zstd for files it shrinks, with format 2 trees)")
+}
+
+func validateCompression(compression string) error {
+	if compression == compressionAuto || compression == compressionSnappy || findCodec(compression) != nil {
+		return nil
+	}
+	return fmt.Errorf("invalid compression codec %s", compression)
+}
+
+// treeCompression resolves --compression for the tree format, format 1 watchers only read snappy
+func treeCompression(compression, format string) (string, error) {
+	if format != formatCompat {
+		return compression, nil
+	} else if compression == compressionAuto || compression == compressionSnappy {
+		return compressionSnappy, nil
+	}
+	return "", fmt.Errorf("compression codec %s requires tree format 2, which some agents do not support (see --format)", compression)
+}
+
+// compressContent encodes the content with the codec; with auto, small files are stored uncompressed,
+// and larger ones with zstd unless it does not shrink them
+func compressContent(content []byte, compression string) ([]byte, error) {
+	switch compression {
+	case compressionSnappy:
+		return snappy.Encode(nil, content), nil
+	case compressionAuto:
+		compression = compressionNone
+		if len(content) >= compressMinSize {
+			data, err := findCodec(compressionZstd).encode(content)
+			if err != nil {
+				return nil, fmt.Errorf("error compressing content with %s: %s", compressionZstd, err)
+			} else if len(data) < len(content) {
+				return withCodecHeader(compressionZstd, data), nil
+			}
+		}
+	}
+	c := findCodec(compression)
+	if c == nil {
+		return nil, fmt.Errorf("invalid compression codec %s", compression)
+	}
+	data, err := c.encode(content)
+	if err != nil {
+		return nil, fmt.Errorf("error compressing content with %s: %s", c.name, err)
+	}
+	return withCodecHeader(c.name, data), nil
+}
+
+func withCodecHeader(name string, data []byte) []byte {
+	value := make([]byte, 0, len(codecMagic)+1+len(data))
+	value = append(value, codecMagic...)
+	value = append(value, findCodec(name).id)
+	return append(value, data...)
+}
+
+// decompressContent decodes the value compressed with any codec up to the size limit, values without
+// a header are legacy snappy-encoded ones
+func decompressContent(value []byte, limit int64) ([]byte, error) {
+	if !bytes.HasPrefix(value, []byte(codecMagic)) {
+		if n, err := snappy.DecodedLen(value); err == nil && int64(n) > limit {
+			return nil, errContentTooLarge
+		}
+		return snappy.Decode(nil, value)
+	} else if len(value) < len(codecMagic)+1 {
+		return nil, errors.New("truncated compressed content")
+	}
+	id := value[len(codecMagic)]
+	for _, c := range codecs {
+		if c.id == id {
+			data, err := c.decode(value[len(codecMagic)+1:], limit)
+			if err != nil {
+				return nil, fmt.Errorf("error decompressing %s content: %s", c.name, err)
+			}
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", id)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	small := []byte("a = 1\n")
+	large := []byte(strings.Repeat("key = value\n", 1000))
+	for _, compression := range []string{compressionAuto, compressionNone, compressionSnappy, compressionGzip, compressionZstd} {
+		for _, content := range [][]byte{nil, small, large} {
+			value, err := compressContent(content, compression)
+			if err != nil {
+				t.Fatalf("%s: %s", compression, err)
+			}
+			data, err := decompressContent(value, maxContentSize)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %s", compression, len(content), err)
+			} else if !bytes.Equal(data, content) {
+				t.Fatalf("%s, %d bytes: content differs after the round trip", compression, len(content))
+			}
+		}
+	}
+	if value, _ := compressContent(small, compressionAuto); !bytes.Equal(value, withCodecHeader(compressionNone, small)) {
+		t.Errorf("small file is compressed with auto: %q", value)
+	}
+	if value, _ := compressContent(large, compressionAuto); !bytes.HasPrefix(value, []byte(codecMagic+"z")) {
+		t.Errorf("large file is not compressed with zstd with auto: %q", value[:3])
+	}
+	if value, _ := compressContent(small, compressionSnappy); bytes.HasPrefix(value, []byte(codecMagic)) {
+		t.Errorf("snappy value has a header: %q", value)
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	content := []byte(strings.Repeat("x", 1000))
+	for _, compression := range []string{compressionNone, compressionSnappy, compressionGzip, compressionZstd} {
+		value, err := compressContent(content, compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = decompressContent(value, int64(len(content))); err != nil {
+			t.Errorf("%s: content within the limit: %s", compression, err)
+		}
+		if _, err = decompressContent(value, int64(len(content)-1)); err == nil || !strings.Contains(err.Error(), errContentTooLarge.Error()) {
+			t.Errorf("%s: content exceeding the limit: %v", compression, err)
+		}
+	}
+	// zstd frames declaring more than the decoder accepts are not decoded
+	huge := make([]byte, maxContentSize+1)
+	value, err := compressContent(huge, compressionZstd)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = decompressContent(value, maxContentSize); err == nil {
+		t.Error("zstd content exceeding the decoder limit is decoded")
+	}
+}
+
+func TestDecompressInvalid(t *testing.T) {
+	for _, value := range [][]byte{
+		[]byte(codecMagic),
+		[]byte(codecMagic + "q"),
+		[]byte(codecMagic + "gnot gzip"),
+		[]byte(codecMagic + "znot zstd"),
+		[]byte("not snappy"),
+	} {
+		if _, err := decompressContent(value, maxContentSize); err == nil {
+			t.Errorf("invalid value %q is decoded", value)
+		}
+	}
+	// legacy snappy-encoded empty content
+	if data, err := decompressContent(snappy.Encode(nil, nil), maxContentSize); err != nil || len(data) != 0 {
+		t.Errorf("empty snappy content: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	changesToEnv   = "env"
+	changesToFile  = "file"
+	changesToStdin = "stdin"
+)
+
+// change lists longer than that are not passed in environment variables, which are limited in size
+const maxEnvListSize = 64 << 10
+
+func validateChangesTo(value string) error {
+	switch value {
+	case changesToEnv, changesToFile, changesToStdin:
+		return nil
+	}
+	return errors.New("invalid changes value " + value)
+}
+
+// runCommand runs the command, terminating it if ctx is done before it exits
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	reason := "interrupted"
+	if ctx.Err() == context.DeadlineExceeded {
+		reason = "timed out"
+	} else {
+		atomic.AddInt32(&interruptedCommands, 1)
+	}
+	log.warn("terminating command", "command", cmd.Path, "reason", reason)
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(commandTerminateTimeout):
+		log.warn("killing command", "command", cmd.Path)
+		_ = cmd.Process.Kill()
+		<-done
+	}
+	return fmt.Errorf("command %s %s", cmd.Path, reason)
+}
+
+// commandContext limits the command run time with the reload timeout
+func (w *watcher) commandContext() (context.Context, context.CancelFunc) {
+	if w.reloadTimeout > 0 {
+		return context.WithTimeout(w.cmdCtx, w.reloadTimeout)
+	}
+	return context.WithCancel(w.cmdCtx)
+}
+
+// execute runs the watcher command with the change details passed in the environment (and a file or stdin)
+func (w *watcher) execute(path string, args []string, dir string, rev int64, changes *treeChanges, env ...string) error {
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   args,
+		Dir:    dir,
+		Env:    append(append(os.Environ(), w.env...), w.commandEnv(rev, changes)...),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	cmd.Env = append(cmd.Env, env...)
+	switch w.changesTo {
+	case changesToFile:
+		f, err := ioutil.TempFile("", "confsync-changes")
+		if err != nil {
+			return fmt.Errorf("error writing changes file: %s", err)
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(changeLines(changes))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("error writing changes file: %s", err)
+		}
+		cmd.Env = append(cmd.Env, "CONFSYNC_CHANGES_FILE="+f.Name())
+	case changesToStdin:
+		cmd.Stdin = bytes.NewReader(changeLines(changes))
+	}
+	ctx, cancel := w.commandContext()
+	defer cancel()
+	return runCommand(ctx, cmd)
+}
+
+// commandEnv describes the changes in CONFSYNC_* environment variables
+func (w *watcher) commandEnv(rev int64, changes *treeChanges) []string {
+	root, _ := filepath.Abs(w.root)
+	env := []string{
+		"CONFSYNC_PREFIX=" + w.prefix,
+		"CONFSYNC_ROOT=" + root,
+		"CONFSYNC_REVISION=" + strconv.FormatInt(rev, 10),
+	}
+	if w.versions > 0 {
+		if cur := w.currentVersion(); cur != "" {
+			env = append(env, "CONFSYNC_VERSION="+filepath.Base(cur))
+		}
+	}
+	updated := strings.Join(sortedPaths(changes.updated), "\n")
+	removed := strings.Join(sortedPaths(changes.removed), "\n")
+	if len(updated)+len(removed) > maxEnvListSize {
+		return append(env, "CONFSYNC_CHANGED=", "CONFSYNC_REMOVED=", "CONFSYNC_CHANGES_TRUNCATED=1")
+	}
+	return append(env, "CONFSYNC_CHANGED="+updated, "CONFSYNC_REMOVED="+removed)
+}
+
+// changeLines lists the changes as "U <path>" and "D <path>" lines
+func changeLines(changes *treeChanges) []byte {
+	var buf bytes.Buffer
+	for _, rel := range sortedPaths(changes.updated) {
+		fmt.Fprintf(&buf, "U %s\n", rel)
+	}
+	for _, rel := range sortedPaths(changes.removed) {
+		fmt.Fprintf(&buf, "D %s\n", rel)
+	}
+	return buf.Bytes()
+}
+
+func (w *watcher) runCmd(rev int64) bool {
+	start := time.Now()
+	err := w.execute(w.cmd, w.args, w.root, rev, w.changes)
+	w.recordCommandRun(commandKindReload, start, err)
+	if err != nil {
+		w.log().error("command failed", "command", w.cmd, "revision", rev, "error", err)
+		w.recordCommand(commandFailed, err)
+		return false
+	}
+	w.recordCommand(commandOK, nil)
+	return true
+}
+
+// runCheck runs the check command against the staged tree
+func (w *watcher) runCheck(staging, root string, rev int64, changes *treeChanges) bool {
+	if w.stopping() {
+		w.log().info("watcher is stopping, not running the check command", "command", w.checkCmd, "revision", rev)
+		return false
+	}
+	args := make([]string, len(w.checkArgs))
+	for i, arg := range w.checkArgs {
+		args[i] = strings.NewReplacer("{staging}", staging, "{root}", root).Replace(arg)
+	}
+	start := time.Now()
+	err := w.execute(w.checkCmd, args, staging, rev, changes, "CONFSYNC_STAGING="+staging)
+	w.recordCommandRun(commandKindCheck, start, err)
+	if err != nil {
+		w.log().error("check failed, keeping the previous files", "command", w.checkCmd, "revision", rev, "error", err)
+		w.recordCommand(commandCheckFailed, err)
+		w.reportStatus()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-shellwords"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// watcherConfig defines a single watcher, either in the config file or by watch command arguments;
+// unset optional settings default to the watch command flags
+type watcherConfig struct {
+	name              string
+	Prefix            string            `json:"prefix"`
+	Root              string            `json:"root"`
+	Owner             string            `json:"owner,omitempty"`
+	Group             string            `json:"group,omitempty"`
+	Mode              fileModeValue     `json:"mode,omitempty"`
+	Command           commandLine       `json:"command"`
+	Check             commandLine       `json:"check,omitempty"`
+	Env               map[string]string `json:"env,omitempty"`
+	QuietPeriod       *durationValue    `json:"quiet-period,omitempty"`
+	MaxDelay          *durationValue    `json:"max-delay,omitempty"`
+	MinReloadInterval *durationValue    `json:"min-reload-interval,omitempty"`
+	Prune             string            `json:"prune,omitempty"`
+	FileMeta          string            `json:"file-meta,omitempty"`
+	Versions          *int              `json:"versions,omitempty"`
+	Rollback          *bool             `json:"rollback,omitempty"`
+	ReloadTimeout     *durationValue    `json:"reload-timeout,omitempty"`
+	ReloadFailure     string            `json:"reload-failure,omitempty"`
+	ReloadRetries     *int              `json:"reload-retries,omitempty"`
+	ReloadBackoff     *durationValue    `json:"reload-backoff,omitempty"`
+	Changes           string            `json:"changes,omitempty"`
+}
+
+// commandLine is either a list of arguments or a string split into arguments as a shell does
+type commandLine []string
+
+func (c *commandLine) UnmarshalJSON(data []byte) error {
+	var line string
+	if err := json.Unmarshal(data, &line); err != nil {
+		if err = json.Unmarshal(data, (*[]string)(c)); err != nil {
+			return errors.New("command must be a string or a list of strings")
+		}
+		return nil
+	}
+	args, err := shellwords.Parse(line)
+	if err != nil {
+		return fmt.Errorf("error parsing command %s: %s", line, err)
+	}
+	*c = args
+	return nil
+}
+
+// fileModeValue is an octal string, or a number (YAML reads unquoted 0644 as an octal number)
+type fileModeValue string
+
+func (m *fileModeValue) UnmarshalJSON(data []byte) error {
+	var mode uint32
+	if err := json.Unmarshal(data, (*string)(m)); err == nil {
+		return nil
+	} else if err = json.Unmarshal(data, &mode); err != nil {
+		return errors.New("file mode must be an octal string or number")
+	}
+	*m = fileModeValue(strconv.FormatUint(uint64(mode), 8))
+	return nil
+}
+
+type durationValue time.Duration
+
+func (d *durationValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("duration must be a string like 1m30s")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = durationValue(v)
+	return nil
+}
+
+// keepalived section keys, mapped to the watch command flags
+var keepalivedConfigFlags = map[string]string{
+	"fifo":     "ka-fifo",
+	"instance": "ka-instance",
+	"key":      "ka-key",
+}
+
+// loadWatchConfig reads watchers from the config file, and sets the flags not given in the command line
+// from the top level settings (named as the watch command flags), keepalived and client sections
+func loadWatchConfig(cmd *cobra.Command, path string) ([]*watcherConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %s", err)
+	} else if data, err = yaml.YAMLToJSON(data); err != nil {
+		return nil, fmt.Errorf("config %s: %s", path, err)
+	}
+	var (
+		cfg  map[string]json.RawMessage
+		defs []*watcherConfig
+	)
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("config %s: %s", path, err)
+	}
+	names := make([]string, 0, len(cfg))
+	for name := range cfg {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch name {
+		case "watchers":
+			var items []json.RawMessage
+			if err = json.Unmarshal(cfg[name], &items); err != nil {
+				return nil, fmt.Errorf("config %s: watchers: must be a list", path)
+			}
+			for i, item := range items {
+				wc := &watcherConfig{name: fmt.Sprintf("watchers[%d]", i)}
+				dec := json.NewDecoder(bytes.NewReader(item))
+				dec.DisallowUnknownFields()
+				if err = dec.Decode(wc); err != nil {
+					return nil, fmt.Errorf("config %s: %s: %s", path, wc.name, strings.TrimPrefix(err.Error(), "json: "))
+				}
+				defs = append(defs, wc)
+			}
+		case "client", "keepalived":
+			var section map[string]json.RawMessage
+			if err = json.Unmarshal(cfg[name], &section); err != nil {
+				return nil, fmt.Errorf("config %s: %s: must be a mapping", path, name)
+			}
+			for key, value := range section {
+				var f *pflag.Flag
+				if name == "client" {
+					f = cmd.Root().PersistentFlags().Lookup(key)
+				} else if flag, ok := keepalivedConfigFlags[key]; ok {
+					f = cmd.Flags().Lookup(flag)
+				}
+				if f == nil {
+					return nil, fmt.Errorf("config %s: %s.%s: unknown setting", path, name, key)
+				} else if err = setConfigFlag(f, value); err != nil {
+					return nil, fmt.Errorf("config %s: %s.%s: %s", path, name, key, err)
+				}
+			}
+		default:
+			f := cmd.LocalNonPersistentFlags().Lookup(name)
+			if f == nil || name == "config" || name == "help" {
+				return nil, fmt.Errorf("config %s: %s: unknown setting", path, name)
+			} else if err = setConfigFlag(f, cfg[name]); err != nil {
+				return nil, fmt.Errorf("config %s: %s: %s", path, name, err)
+			}
+		}
+	}
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("config %s: no watchers defined", path)
+	}
+	return defs, nil
+}
+
+// setConfigFlag sets the flag from the config value, unless it is set in the command line
+func setConfigFlag(f *pflag.Flag, data json.RawMessage) error {
+	if f.Changed {
+		return nil
+	}
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+	values := []interface{}{value}
+	if list, ok := value.([]interface{}); ok {
+		values = list
+	}
+	items := make([]string, len(values))
+	for i, v := range values {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}, nil:
+			return errors.New("invalid value")
+		}
+		items[i] = fmt.Sprint(v)
+	}
+	// lists replace the flag value, so the config may be read again
+	if sv, ok := f.Value.(pflag.SliceValue); ok {
+		return sv.Replace(items)
+	} else if len(items) != 1 {
+		return errors.New("single value expected")
+	}
+	return f.Value.Set(items[0])
+}
+
+// resetConfigFlags resets the watch command flags, which are not set in the command line, to defaults
+// before reading the config file again
+func resetConfigFlags(cmd *cobra.Command) {
+	cmd.LocalNonPersistentFlags().VisitAll(func(f *pflag.Flag) {
+		if f.Changed || f.Name == "config" || f.Name == "help" {
+			return
+		} else if sv, ok := f.Value.(pflag.SliceValue); ok {
+			_ = sv.Replace(nil)
+		} else {
+			_ = f.Value.Set(f.DefValue)
+		}
+	})
+}
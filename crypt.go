@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// encrypted values start with a zero byte, which can't start snappy-encoded non-empty content,
+// followed by the format version, the list of keys the content key is wrapped with, and the content
+// encrypted with AES-256-GCM, bound to the file path
+const encryptedMagic = "\x00E1"
+
+var keygenSign bool
+
+const (
+	keySize   = 32
+	keyIDSize = 8
+	saltSize  = 16
+	nonceSize = 12
+)
+
+const (
+	// shared secret keys wrap the content key with AES-256-GCM
+	keyKindSecret byte = 'k'
+	// recipient public keys wrap the content key in an anonymous NaCl box
+	keyKindBox byte = 'r'
+)
+
+var wrappedKeySize = map[byte]int{
+	keyKindSecret: nonceSize + keySize + 16,
+	keyKindBox:    box.AnonymousOverhead + keySize,
+}
+
+// contentKey is a secret key, or a box key pair, private key of which is only known to recipients
+type contentKey struct {
+	kind byte
+	id   []byte
+	key  *[keySize]byte
+	pub  *[keySize]byte
+}
+
+// readKeyFile reads a base64-encoded 32 byte key
+func readKeyFile(path string) (*[keySize]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %s", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(raw) != keySize {
+		return nil, fmt.Errorf("invalid key file %s: must contain %d base64-encoded bytes", path, keySize)
+	}
+	key := new([keySize]byte)
+	copy(key[:], raw)
+	return key, nil
+}
+
+func newSecretKey(key *[keySize]byte) *contentKey {
+	h := sha256.Sum256(append([]byte("confsync secret key\x00"), key[:]...))
+	return &contentKey{kind: keyKindSecret, id: h[:keyIDSize], key: key}
+}
+
+func newBoxKey(pub, priv *[keySize]byte) *contentKey {
+	h := sha256.Sum256(pub[:])
+	return &contentKey{kind: keyKindBox, id: h[:keyIDSize], key: priv, pub: pub}
+}
+
+func boxPublicKey(priv *[keySize]byte) *[keySize]byte {
+	pub := new([keySize]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	return pub
+}
+
+func (k *contentKey) String() string {
+	return string(k.kind) + ":" + hex.EncodeToString(k.id)
+}
+
+func (k *contentKey) wrap(contentKey []byte) ([]byte, error) {
+	if k.kind == keyKindBox {
+		return box.SealAnonymous(nil, contentKey, k.pub, rand.Reader)
+	}
+	return sealGCM(k.key[:], contentKey, nil)
+}
+
+func (k *contentKey) unwrap(wrapped []byte) ([]byte, error) {
+	if k.kind == keyKindBox {
+		if key, ok := box.OpenAnonymous(nil, wrapped, k.pub, k.key); ok {
+			return key, nil
+		}
+		return nil, errors.New("message authentication failed")
+	}
+	return openGCM(k.key[:], wrapped, nil)
+}
+
+func sealGCM(key, plain, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize, nonceSize+len(plain)+gcm.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, aad), nil
+}
+
+func openGCM(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	} else if len(sealed) < nonceSize {
+		return nil, errors.New("truncated ciphertext")
+	}
+	return gcm.Open(nil, sealed[:nonceSize], sealed[nonceSize:], aad)
+}
+
+// contentEncryption encrypts the content stored by put for all of its keys
+type contentEncryption struct {
+	keys []*contentKey
+}
+
+// loadContentEncryption reads shared secret and recipient public key files, it returns nil if none given
+func loadContentEncryption(secretFiles, recipientFiles []string) (*contentEncryption, error) {
+	if len(secretFiles)+len(recipientFiles) == 0 {
+		return nil, nil
+	} else if len(secretFiles)+len(recipientFiles) > 255 {
+		return nil, errors.New("too many encryption keys")
+	}
+	e := &contentEncryption{}
+	for _, fn := range secretFiles {
+		key, err := readKeyFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		e.keys = append(e.keys, newSecretKey(key))
+	}
+	for _, fn := range recipientFiles {
+		pub, err := readKeyFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		e.keys = append(e.keys, newBoxKey(pub, nil))
+	}
+	return e, nil
+}
+
+func (e *contentEncryption) keyNames() []string {
+	names := make([]string, len(e.keys))
+	for i, k := range e.keys {
+		names[i] = k.String()
+	}
+	return names
+}
+
+// encode compresses the content with the codec and, if encryption is enabled, encrypts it, and returns
+// it with its digest; encrypted content is digested with a salt kept in its metadata, so the digest can't be
+// looked up, the salt of the stored metadata is reused to keep the digest of unchanged content
+func (e *contentEncryption) encode(rel string, content []byte, meta, stored *fileMeta, compression string) (data, digest []byte, err error) {
+	if e == nil {
+		return encodeContent(content, compression)
+	}
+	meta.Keys = e.keyNames()
+	if stored != nil && len(stored.Salt) == 2*saltSize {
+		meta.Salt = stored.Salt
+	} else {
+		salt := make([]byte, saltSize)
+		if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, nil, err
+		}
+		meta.Salt = hex.EncodeToString(salt)
+	}
+	salt, _ := hex.DecodeString(meta.Salt)
+	digest = contentDigest(salt, content)
+	if data, err = compressContent(content, compression); err != nil {
+		return nil, nil, err
+	}
+	data, err = e.seal(rel, data)
+	return
+}
+
+func (e *contentEncryption) seal(rel string, plain []byte) ([]byte, error) {
+	ck := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, ck); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(encryptedMagic)
+	buf.WriteByte(byte(len(e.keys)))
+	for _, k := range e.keys {
+		wrapped, err := k.wrap(ck)
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting content key for %s: %s", k, err)
+		}
+		buf.WriteByte(k.kind)
+		buf.Write(k.id)
+		buf.Write(wrapped)
+	}
+	sealed, err := sealGCM(ck, plain, []byte(rel))
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(sealed)
+	return buf.Bytes(), nil
+}
+
+// keyring returns the shared secret keys, which decrypt the content as well
+func (e *contentEncryption) keyring() *keyring {
+	if e == nil {
+		return nil
+	}
+	kr := &keyring{}
+	for _, k := range e.keys {
+		if k.kind == keyKindSecret {
+			kr.keys = append(kr.keys, k)
+		}
+	}
+	return kr
+}
+
+// keyring holds the local keys to decrypt the content with, each key file may hold a shared secret
+// key or a recipient private key
+type keyring struct {
+	keys []*contentKey
+}
+
+func loadKeyring(files []string) (*keyring, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	kr := &keyring{}
+	for _, fn := range files {
+		key, err := readKeyFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys = append(kr.keys, newSecretKey(key), newBoxKey(boxPublicKey(key), key))
+	}
+	return kr, nil
+}
+
+func (kr *keyring) find(kind byte, id []byte) *contentKey {
+	if kr == nil {
+		return nil
+	}
+	for _, k := range kr.keys {
+		if k.kind == kind && bytes.Equal(k.id, id) {
+			return k
+		}
+	}
+	return nil
+}
+
+func isEncrypted(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(encryptedMagic))
+}
+
+// decodeContent decrypts, if the value is encrypted, and decompresses the stored content of the file
+// at rel path up to the size limit, failing if none of the keys it is encrypted with is in the keyring
+func decodeContent(rel string, value []byte, kr *keyring, limit int64) ([]byte, error) {
+	if !isEncrypted(value) {
+		return decompressContent(value, limit)
+	}
+	value = value[len(encryptedMagic):]
+	if len(value) < 1 {
+		return nil, errors.New("truncated encrypted content")
+	}
+	n := int(value[0])
+	value = value[1:]
+	var (
+		ck    []byte
+		names []string
+	)
+	for i := 0; i < n; i++ {
+		if len(value) < 1+keyIDSize {
+			return nil, errors.New("truncated encrypted content")
+		}
+		kind, id := value[0], value[1:1+keyIDSize]
+		size, ok := wrappedKeySize[kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown key kind %q", kind)
+		} else if len(value) < 1+keyIDSize+size {
+			return nil, errors.New("truncated encrypted content")
+		}
+		wrapped := value[1+keyIDSize : 1+keyIDSize+size]
+		value = value[1+keyIDSize+size:]
+		names = append(names, string(kind)+":"+hex.EncodeToString(id))
+		if k := kr.find(kind, id); k != nil && ck == nil {
+			var err error
+			if ck, err = k.unwrap(wrapped); err != nil {
+				return nil, fmt.Errorf("error decrypting content key with %s: %s", k, err)
+			}
+		}
+	}
+	if ck == nil {
+		return nil, fmt.Errorf("content is encrypted and none of its keys (%s) is available", strings.Join(names, ", "))
+	}
+	plain, err := openGCM(ck, value, []byte(rel))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting content: %s", err)
+	}
+	return decompressContent(plain, limit)
+}
+
+func newKeygenCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keygen <key-file>",
+		Short: "Generates a key to encrypt the stored file content or to sign the tree with",
+		Long: `keygen command generates a random key, writes it to the key file, and its public key to the key
+file with .pub suffix.
+
+The key file may be given to put --encrypt-key as a shared secret key, or kept by watch agents only,
+with the public key given to put --recipient; in both cases watch --decrypt-key takes the key file.
+
+With --sign, the key is a signing key for put --sign-key, and its public key file may be given to
+watch --trusted-keys.
+
+Example:
+
+confsync keygen /etc/confsync/content.key
+
+`,
+		RunE: keygenCommandFunc,
+		Args: cobra.ExactArgs(1),
+	}
+	cmd.Flags().BoolVar(&keygenSign, "sign", false, "generate a key to sign tree manifests with")
+	return cmd
+}
+
+func keygenCommandFunc(cmd *cobra.Command, args []string) error {
+	key := new([keySize]byte)
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return err
+	}
+	var pub []byte
+	if keygenSign {
+		pub = ed25519.NewKeyFromSeed(key[:]).Public().(ed25519.PublicKey)
+	} else {
+		pub = boxPublicKey(key)[:]
+	}
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating key file: %s", err)
+	}
+	_, err = fmt.Fprintln(f, base64.StdEncoding.EncodeToString(key[:]))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = ioutil.WriteFile(args[0]+".pub", []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing key file: %s", err)
+	}
+	if keygenSign {
+		fmt.Printf("signing key %s\n", signingKeyID(pub))
+	} else {
+		fmt.Printf("secret key %s, recipient key %s\n", newSecretKey(key), newBoxKey(boxPublicKey(key), key))
+	}
+	return nil
+}
+
+func addEncryptionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&putEncryptKeys, "encrypt-key", nil, "shared secret key `file` to encrypt file content with (may be repeated)")
+	cmd.Flags().StringArrayVar(&putRecipients, "recipient", nil, "recipient public key `file` to encrypt file content for (may be repeated)")
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.etcd.io/etcd/clientv3"
+)
+
+const diffContext = 3
+
+func newDiffCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff [flags] <prefix> [<directory>]",
+		Short: "Shows the difference between given directory and the store",
+		Long: `Compares the content of given directory with the files stored under the prefix key namespace
+and reports files that put command would add, update or remove, without updating anything.
+
+With --encrypt-key or --recipient, diff command compares the tree as put command would encrypt it.
+Unified diff shows the stored content of encrypted files only if it's encrypted with one of the
+shared secret keys given.
+
+diff command exits with non-zero status if there are any differences, the same as put --dry-run.
+
+Example:
+
+confsync diff -u /etc/firewall/keepalived
+
+`,
+		RunE: diffCommandFunc,
+		Args: cobra.RangeArgs(1, 2),
+	}
+	cmd.Flags().IntVar(&putMaxTxnOps, "max-txn-ops", defaultMaxTxnOps, "maximum `number` of operations in a single transaction")
+	cmd.Flags().BoolVar(&putOwnership, "ownership", false, "compare file owner and group names along with file modes")
+	cmd.Flags().BoolVarP(&putUnified, "unified", "u", false, "show unified diff of changed files")
+	addEncryptionFlags(cmd)
+	addFormatFlag(cmd)
+	addCompressionFlag(cmd)
+	return cmd
+}
+
+func diffCommandFunc(cmd *cobra.Command, args []string) error {
+	var root string
+	if putMaxTxnOps <= 0 {
+		return fmt.Errorf("transaction limits must be positive")
+	}
+	if len(args) > 1 {
+		root = args[1]
+	}
+	var err error
+	if err = validateFormat(putFormat); err != nil {
+		return err
+	} else if err = validateCompression(putCompression); err != nil {
+		return err
+	} else if putEncryption, err = loadContentEncryption(putEncryptKeys, putRecipients); err != nil {
+		return err
+	}
+	return diffTree(cmd, mustClient(), args[0], root, putUnified)
+}
+
+func diffTree(cmd *cobra.Command, c clientv3.KV, prefix, root string, unified bool) error {
+	changes, _, err := planTree(c, prefix, root)
+	if err != nil {
+		return err
+	}
+	var stored map[string][]byte
+	if unified {
+		keys := make([]string, 0, len(changes))
+		for _, ch := range changes {
+			if !ch.isNew {
+				keys = append(keys, ch.key)
+			}
+		}
+		if stored, err = getValues(c, keys); err != nil {
+			return err
+		}
+	}
+	for _, ch := range changes {
+		if ch.isDel {
+			fmt.Printf("removed %s\n", ch.key)
+		} else if ch.dropAttrs {
+			fmt.Printf("migrated %s\n", ch.key)
+			continue
+		} else if ch.isNew {
+			fmt.Printf("added %s\n", ch.key)
+		} else {
+			fmt.Printf("updated %s\n", ch.key)
+		}
+		if !unified {
+			continue
+		}
+		var old, cur []byte
+		if v, ok := stored[ch.key]; ok {
+			rel, _ := entryRelPath(prefix, ch.key)
+			if old, err = decodeContent(rel, v, putEncryption.keyring(), maxContentSize); err != nil {
+				log.error("error decoding stored content", "key", ch.key, "error", err)
+				continue
+			}
+		}
+		if !ch.isDel {
+			if cur, err = localContent(ch.path); err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(old, cur) {
+			writeUnifiedDiff(os.Stdout, ch.key, ch.path, old, cur)
+		}
+	}
+	if len(changes) > 0 {
+		cmd.SilenceErrors, cmd.SilenceUsage = true, true
+		return exitStatus(1)
+	}
+	return nil
+}
+
+type diffEdit struct {
+	kind byte
+	a, b int
+}
+
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes the shortest edit script turning a into b (E. Myers, "An O(ND) Difference Algorithm
+// and Its Variations")
+func diffLines(a, b []string) []diffEdit {
+	var (
+		n, m   = len(a), len(b)
+		offset = n + m + 1
+		v      = make([]int, 2*offset+1)
+		trace  [][]int
+	)
+Search:
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break Search
+			}
+		}
+	}
+	var (
+		edits = make([]diffEdit, 0, n+m)
+		x, y  = n, m
+	)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var pk int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := v[offset+pk]
+		py := px - pk
+		for x > px && y > py {
+			x--
+			y--
+			edits = append(edits, diffEdit{kind: ' ', a: x, b: y})
+		}
+		if d > 0 {
+			if x == px {
+				y--
+				edits = append(edits, diffEdit{kind: '+', a: x, b: y})
+			} else {
+				x--
+				edits = append(edits, diffEdit{kind: '-', a: x, b: y})
+			}
+		}
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+func writeUnifiedDiff(w io.Writer, nameA, nameB string, a, b []byte) {
+	if bytes.IndexByte(a, 0) >= 0 || bytes.IndexByte(b, 0) >= 0 {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", nameA, nameB)
+		return
+	}
+	la, lb := splitLines(a), splitLines(b)
+	edits := diffLines(la, lb)
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+	for i := 0; i < len(edits); {
+		if edits[i].kind == ' ' {
+			i++
+			continue
+		}
+		start, last := i-diffContext, i
+		if start < 0 {
+			start = 0
+		}
+		for j := i; j < len(edits) && j-last <= 2*diffContext; j++ {
+			if edits[j].kind != ' ' {
+				last = j
+			}
+		}
+		end := last + diffContext + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+		hunk := edits[start:end]
+		na, nb := 0, 0
+		for _, e := range hunk {
+			if e.kind != '+' {
+				na++
+			}
+			if e.kind != '-' {
+				nb++
+			}
+		}
+		sa, sb := hunk[0].a+1, hunk[0].b+1
+		if na == 0 {
+			sa--
+		}
+		if nb == 0 {
+			sb--
+		}
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", sa, na, sb, nb)
+		for _, e := range hunk {
+			line := ""
+			if e.kind == '+' {
+				line = lb[e.b]
+			} else {
+				line = la[e.a]
+			}
+			if strings.HasSuffix(line, "\n") {
+				fmt.Fprintf(w, "%c%s", e.kind, line)
+			} else {
+				fmt.Fprintf(w, "%c%s\n\\ No newline at end of file\n", e.kind, line)
+			}
+		}
+		i = end
+	}
+}
+
+// localContent reads the file content as put command stores it, directories and symlinks have none
+func localContent(path string) ([]byte, error) {
+	if fi, err := os.Lstat(path); err != nil {
+		return nil, err
+	} else if !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+	return ioutil.ReadFile(path)
+}
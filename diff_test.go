@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// lcsLength returns the length of the longest common subsequence of the lines
+func lcsLength(a, b []string) int {
+	l := make([][]int, len(a)+1)
+	for i := range l {
+		l[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				l[i][j] = l[i+1][j+1] + 1
+			} else if l[i+1][j] > l[i][j+1] {
+				l[i][j] = l[i+1][j]
+			} else {
+				l[i][j] = l[i][j+1]
+			}
+		}
+	}
+	return l[0][0]
+}
+
+// checkEdits checks that the edits turn a into b with the least number of changed lines
+func checkEdits(t *testing.T, a, b []string) {
+	edits := diffLines(a, b)
+	var ra, rb []string
+	changed := 0
+	for _, e := range edits {
+		switch e.kind {
+		case ' ':
+			if e.a != len(ra) || e.b != len(rb) || a[e.a] != b[e.b] {
+				t.Fatalf("diff of %q and %q: invalid common line %+v", a, b, e)
+			}
+			ra, rb = append(ra, a[e.a]), append(rb, b[e.b])
+		case '-':
+			if e.a != len(ra) {
+				t.Fatalf("diff of %q and %q: invalid removed line %+v", a, b, e)
+			}
+			ra = append(ra, a[e.a])
+			changed++
+		case '+':
+			if e.b != len(rb) {
+				t.Fatalf("diff of %q and %q: invalid added line %+v", a, b, e)
+			}
+			rb = append(rb, b[e.b])
+			changed++
+		default:
+			t.Fatalf("diff of %q and %q: invalid edit %+v", a, b, e)
+		}
+	}
+	if len(ra) != len(a) || len(rb) != len(b) {
+		t.Fatalf("diff of %q and %q: edits do not cover the lines", a, b)
+	} else if min := len(a) + len(b) - 2*lcsLength(a, b); changed != min {
+		t.Fatalf("diff of %q and %q: %d lines changed, %d at least", a, b, changed, min)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	for _, tc := range [][2]string{
+		{"", ""},
+		{"", "a\n"},
+		{"a\n", ""},
+		{"a\nb\nc\n", "a\nb\nc\n"},
+		{"a\nb\nc\n", "a\nc\n"},
+		{"a\nb\nc\n", "x\na\nb\nc\ny\n"},
+		{"a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n"},
+		{"a\nb", "a\nb\n"},
+	} {
+		checkEdits(t, splitLines([]byte(tc[0])), splitLines([]byte(tc[1])))
+	}
+	r := rand.New(rand.NewSource(1))
+	lines := func() []string {
+		l := make([]string, r.Intn(20))
+		for i := range l {
+			l[i] = string(rune('a'+r.Intn(4))) + "\n"
+		}
+		return l
+	}
+	for i := 0; i < 500; i++ {
+		checkEdits(t, lines(), lines())
+	}
+}
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	for _, tc := range []struct {
+		a, b, diff string
+	}{
+		{
+			"1\n2\n3\n", "1\n2x\n3\n",
+			"--- a\n+++ b\n@@ -1,3 +1,3 @@\n 1\n-2\n+2x\n 3\n",
+		},
+		{
+			"", "1\n",
+			"--- a\n+++ b\n@@ -0,0 +1,1 @@\n+1\n",
+		},
+		{
+			"1\n2", "1\n2\n",
+			"--- a\n+++ b\n@@ -1,2 +1,2 @@\n 1\n-2\n\\ No newline at end of file\n+2\n",
+		},
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			"--- a\n+++ b\n@@ -1,3 +1,4 @@\n+0\n 1\n 2\n 3\n@@ -7,4 +8,3 @@\n 7\n 8\n 9\n-10\n",
+		},
+		{
+			"a\x00", "b\x00",
+			"Binary files a and b differ\n",
+		},
+	} {
+		var buf bytes.Buffer
+		writeUnifiedDiff(&buf, "a", "b", []byte(tc.a), []byte(tc.b))
+		if buf.String() != tc.diff {
+			t.Errorf("diff of %q and %q:\n%s\nexpected:\n%s", tc.a, tc.b, buf.String(), strings.TrimSuffix(tc.diff, "\n"))
+		}
+	}
+}
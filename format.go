@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// tree formats: in format 1 each entry is stored with its content key, and .hash and .meta keys
+// holding its digest and metadata; in format 2 the tree manifest lists the digests and metadata of
+// all the entries, and only the content keys are stored next to it
+const (
+	treeFormatLegacy = 1
+	// the latest format this version reads and writes
+	treeFormat = 2
+)
+
+// put --format values
+const (
+	formatAuto   = "auto"
+	formatCompat = "compat"
+	formatLatest = "2"
+)
+
+// treeManifest is stored in the manifest key of the tree with the tree generation, it lists every
+// entry of the tree with the digest and size of its content and its metadata
+type treeManifest struct {
+	Format  int                       `json:"format"`
+	Prefix  string                    `json:"prefix"`
+	Entries map[string]*manifestEntry `json:"entries"`
+}
+
+type manifestEntry struct {
+	Hash string `json:"hash"`
+	// content size, unknownSize for entries carried over from trees stored without a manifest
+	Size int64 `json:"size"`
+	fileMeta
+}
+
+const unknownSize = -1
+
+// signedManifest is the stored manifest value, the encoded manifest along with its signature, if signed
+type signedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Key       string          `json:"key,omitempty"`
+	Signature []byte          `json:"signature,omitempty"`
+}
+
+func newTreeManifest(prefix string) *treeManifest {
+	return &treeManifest{Format: treeFormat, Prefix: path.Clean(prefix), Entries: make(map[string]*manifestEntry)}
+}
+
+func (m *treeManifest) add(rel string, digest []byte, size int, meta *fileMeta) {
+	m.Entries[rel] = &manifestEntry{Hash: string(digest), Size: int64(size), fileMeta: *meta}
+}
+
+// entry returns the manifest entry, nil if the manifest or the entry is missing
+func (m *treeManifest) entry(rel string) *manifestEntry {
+	if m == nil {
+		return nil
+	}
+	return m.Entries[rel]
+}
+
+func (e *manifestEntry) meta() *fileMeta {
+	meta := e.fileMeta
+	return &meta
+}
+
+// encode returns the stored manifest value, signed if the signer is given
+func (m *treeManifest) encode(s *manifestSigner) ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	sm := &signedManifest{Manifest: data}
+	if s != nil {
+		sm.Key, sm.Signature = s.sign(data)
+	}
+	return json.Marshal(sm)
+}
+
+// decodeManifest decodes the stored manifest of the tree under the prefix, verifying its signature
+// if trusted keys are given
+func decodeManifest(prefix string, value []byte, trusted *trustedKeys) (*treeManifest, error) {
+	sm := &signedManifest{}
+	if err := json.Unmarshal(value, sm); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %s", err)
+	} else if trusted != nil {
+		if err = trusted.verify(sm); err != nil {
+			return nil, err
+		}
+	}
+	m := &treeManifest{}
+	if err := json.Unmarshal(sm.Manifest, m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %s", err)
+	} else if m.Format <= treeFormatLegacy || m.Format > treeFormat {
+		return nil, fmt.Errorf("tree format %d is not supported, the latest supported format is %d", m.Format, treeFormat)
+	} else if m.Prefix != path.Clean(prefix) {
+		return nil, fmt.Errorf("manifest is stored for prefix %s", m.Prefix)
+	}
+	return m, nil
+}
+
+// resolve takes the digests and metadata of updated entries from the manifest, entries not listed
+// in it are left without a digest
+func (m *treeManifest) resolve(u *treeUpdates) {
+	for _, rel := range u.order {
+		tu := u.entries[rel]
+		if tu.removed {
+			continue
+		} else if e, ok := m.Entries[rel]; ok {
+			tu.digest, tu.meta = e.Hash, e.meta()
+		} else {
+			tu.digest = ""
+		}
+	}
+}
+
+// keyPath is treeKeyPath for trees with a manifest, keys named as attributes it lists are entries
+func (m *treeManifest) keyPath(prefix, key string) (rel, attr string, ok bool) {
+	if rel, ok := entryRelPath(prefix, key); ok && m.entry(rel) != nil {
+		return rel, "", true
+	}
+	return treeKeyPath(prefix, key)
+}
+
+// resolveAttrKeys applies the keys named as entry attributes, as entries if the manifest lists them,
+// or if they are removed and have been applied as entries before, and as attributes otherwise
+func (u *treeUpdates) resolveAttrKeys(prefix string, m *treeManifest, kr *keyring, applied map[string]string) {
+	for _, ak := range u.attrKeys {
+		key := string(ak.kv.Key)
+		rel, attr, ok := m.keyPath(prefix, key)
+		if entry, isEntry := entryRelPath(prefix, key); isEntry && m != nil && ak.deleted {
+			if _, written := applied[entry]; written {
+				rel, attr, ok = entry, "", true
+			}
+		}
+		if ok {
+			u.addKey(prefix, rel, attr, ak.kv, ak.deleted, kr)
+		}
+	}
+	u.attrKeys = nil
+}
+
+// setManifest decodes the stored manifest value, nil if there's none, and keeps it to resolve the
+// updates with, or the reason the updates can't be applied
+func (w *watcher) setManifest(value []byte) {
+	w.manifest, w.manifestErr = nil, nil
+	if value == nil {
+		if w.trusted != nil {
+			w.manifestErr = errors.New("tree manifest is missing")
+		}
+		return
+	}
+	var err error
+	if w.manifest, err = decodeManifest(w.prefix, value, w.trusted); err != nil {
+		w.manifestErr = err
+		w.log().error("invalid tree manifest", "error", err)
+	}
+}
+
+// loadManifest reads the current manifest of the tree, when the watcher resumes from a known revision
+func (w *watcher) loadManifest(ctx context.Context, c *clientv3.Client) error {
+	value, err := storedManifest(ctx, c, w.prefix)
+	if err != nil {
+		return err
+	}
+	w.setManifest(value)
+	return nil
+}
+
+// resolvePending resolves pending updates with the tree manifest, and verifies them against it if the
+// manifest is required to be signed; trees without a manifest are stored in the legacy format
+func (w *watcher) resolvePending() error {
+	if w.manifestErr != nil {
+		return w.manifestErr
+	}
+	w.pending.resolveAttrKeys(w.prefix, w.manifest, w.keys, w.state.Entries)
+	if w.manifest == nil {
+		return nil
+	}
+	w.manifest.resolve(w.pending)
+	if w.trusted != nil {
+		return w.manifest.verify(w.pending)
+	}
+	return nil
+}
+
+// awaitsManifest tells if the pending updates are of a tree being stored in format 2 for the first
+// time, its files have no digests until the manifest is published along with the tree generation
+func (w *watcher) awaitsManifest() bool {
+	if w.manifest != nil || w.generations {
+		return false
+	}
+	for _, tu := range w.pending.entries {
+		if tu.hasData && tu.digest == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func storedManifest(ctx context.Context, c clientv3.KV, prefix string) ([]byte, error) {
+	resp, err := c.Get(ctx, internalKey(prefix, manifestKey))
+	if err != nil {
+		return nil, err
+	} else if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// publishGeneration writes the tree manifest and the tree generation key in a single transaction,
+// and returns its revision
+func publishGeneration(c clientv3.KV, prefix string, manifest []byte) (int64, error) {
+	resp, err := c.Txn(context.Background()).If().Then(
+		clientv3.OpPut(internalKey(prefix, manifestKey), string(manifest)),
+		clientv3.OpPut(internalKey(prefix, generationKey), time.Now().UTC().Format(time.RFC3339Nano)),
+	).Commit()
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+// manifestTxnSize returns the approximate size of the request publishGeneration makes
+func manifestTxnSize(prefix string, manifest []byte) int {
+	return len(internalKey(prefix, manifestKey)) + len(manifest) + len(internalKey(prefix, generationKey)) + len(time.RFC3339Nano) + 2*txnOpOverhead
+}
+
+// manifestChanged tells if the stored manifest differs from the given one
+func manifestChanged(c clientv3.KV, prefix string, manifest []byte) (bool, error) {
+	stored, err := storedManifest(context.Background(), c, prefix)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(stored, manifest), nil
+}
+
+func addFormatFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&putFormat, "format", formatAuto, "tree `format` to store: 2, compat (format 2 readable by format 1 watchers) or auto (2 once all agents support it)")
+}
+
+func validateFormat(format string) error {
+	switch format {
+	case formatAuto, formatCompat, formatLatest:
+		return nil
+	}
+	return fmt.Errorf("invalid tree format %s", format)
+}
+
+// negotiateFormat picks the format to store the tree in with --format=auto: format 2 once every
+// agent reporting its status for the prefix supports it, otherwise the compatible one
+func negotiateFormat(c clientv3.KV, format, prefix string) (string, error) {
+	if format != formatAuto {
+		return format, nil
+	}
+	statusPrefix := internalKey(prefix, statusDirName) + "/"
+	resp, err := c.Get(context.Background(), statusPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return "", err
+	} else if len(resp.Kvs) == 0 {
+		log.info("no agents report their status, storing the tree in compatible format", "prefix", prefix)
+		return formatCompat, nil
+	}
+	for _, kv := range resp.Kvs {
+		if st, err := decodeAgentStatus(kv); err != nil || st.Format < treeFormat {
+			log.info("agent does not support the latest tree format, storing the tree in compatible format", "prefix", prefix, "agent", strings.TrimPrefix(string(kv.Key), statusPrefix))
+			return formatCompat, nil
+		}
+	}
+	return formatLatest, nil
+}
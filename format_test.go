@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+func TestManifestEncodeDecode(t *testing.T) {
+	m := newTreeManifest("/test/")
+	m.add("a.conf", []byte("digest-a"), 6, &fileMeta{Mode: "0644"})
+	m.add("dir/.hash", []byte("digest-hash"), 3, &fileMeta{Mode: "0600"})
+	m.add(".meta", []byte("digest-meta"), 0, &fileMeta{Mode: "0644"})
+	m.add("dir", nil, 0, &fileMeta{Type: entryTypeDir, Mode: "0755"})
+	value, err := m.encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeManifest("/test", value, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(decoded, m) {
+		t.Fatalf("decoded manifest %+v differs from %+v", decoded, m)
+	}
+	if _, err = decodeManifest("/other", value, nil); err == nil {
+		t.Fatal("manifest of another prefix is accepted")
+	}
+	m.Format = treeFormat + 1
+	if value, err = m.encode(nil); err != nil {
+		t.Fatal(err)
+	} else if _, err = decodeManifest("/test", value, nil); err == nil {
+		t.Fatal("manifest of an unsupported format is accepted")
+	}
+}
+
+func TestManifestKeyPath(t *testing.T) {
+	m := newTreeManifest("/test")
+	m.add("dir/.hash", []byte("digest"), 3, &fileMeta{})
+	m.add(".meta", []byte("digest"), 0, &fileMeta{})
+	for _, tc := range []struct {
+		key       string
+		rel, attr string
+		ok        bool
+	}{
+		{"/test/a.conf", "a.conf", "", true},
+		{"/test/a.conf/.hash", "a.conf", hashKeyName, true},
+		{"/test/dir/.hash", "dir/.hash", "", true},
+		{"/test/dir/.meta", "dir", metaKeyName, true},
+		{"/test/.meta", ".meta", "", true},
+		{"/test/.confsync/manifest", "", "", false},
+	} {
+		rel, attr, ok := m.keyPath("/test", tc.key)
+		if rel != tc.rel || attr != tc.attr || ok != tc.ok {
+			t.Errorf("keyPath(%q) = %q, %q, %v, expected %q, %q, %v", tc.key, rel, attr, ok, tc.rel, tc.attr, tc.ok)
+		}
+	}
+	// trees without a manifest have no entries named as attributes
+	var none *treeManifest
+	if rel, attr, ok := none.keyPath("/test", "/test/dir/.hash"); rel != "dir" || attr != hashKeyName || !ok {
+		t.Errorf("keyPath without a manifest = %q, %q, %v", rel, attr, ok)
+	}
+}
+
+func TestResolveAttrKeys(t *testing.T) {
+	m := newTreeManifest("/test")
+	m.add("dir/.hash", []byte("digest-hash"), 3, &fileMeta{Mode: "0600"})
+	u := newTreeUpdates()
+	for key, value := range map[string]string{
+		"/test/dir/.hash":    "\x00Cnabc",
+		"/test/a.conf/.hash": "digest-a",
+	} {
+		u.add("/test", &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value)}, false, nil)
+	}
+	u.resolveAttrKeys("/test", m, nil, nil)
+	if tu := u.entries["dir/.hash"]; tu == nil || !tu.hasData || string(tu.data) != "abc" {
+		t.Errorf("file named .hash is not resolved as an entry: %+v", tu)
+	}
+	if tu := u.entries["a.conf"]; tu == nil || tu.hasData || tu.digest != "digest-a" {
+		t.Errorf(".hash key is not resolved as the attribute: %+v", tu)
+	}
+	if len(u.attrKeys) != 0 {
+		t.Errorf("attribute keys are left unresolved: %d", len(u.attrKeys))
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+// watcherHealth is the watcher state served on /status, it is updated by the watcher goroutine
+type watcherHealth struct {
+	mu       sync.Mutex
+	watching bool
+	synced   time.Time
+	status   agentStatus
+}
+
+func (h *watcherHealth) setWatching(watching bool) {
+	h.mu.Lock()
+	h.watching = watching
+	h.mu.Unlock()
+}
+
+// sync records the time of the last response from the store
+func (h *watcherHealth) sync() {
+	h.mu.Lock()
+	h.synced = time.Now().UTC()
+	h.mu.Unlock()
+}
+
+func (h *watcherHealth) setRevision(rev int64) {
+	h.mu.Lock()
+	h.status.Revision = rev
+	h.mu.Unlock()
+}
+
+func (h *watcherHealth) update(st *agentStatus) {
+	h.mu.Lock()
+	h.status = *st
+	h.mu.Unlock()
+}
+
+// keepalivedState is the last state of keepalived instances and groups, as reported by keepalived events
+type keepalivedState struct {
+	mu     sync.Mutex
+	states map[string]string
+	event  time.Time
+	err    string
+}
+
+func newKeepalivedState() *keepalivedState {
+	return &keepalivedState{states: make(map[string]string)}
+}
+
+func (s *keepalivedState) update(kind, instance, state string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[kind+"/"+instance], s.event, s.err = state, time.Now().UTC(), ""
+	if err != nil {
+		s.err = err.Error()
+	}
+}
+
+type watcherReport struct {
+	Prefix   string     `json:"prefix"`
+	Watching bool       `json:"watching"`
+	Synced   *time.Time `json:"synced,omitempty"`
+	agentStatus
+}
+
+type keepalivedReport struct {
+	Instance string            `json:"instance"`
+	States   map[string]string `json:"states"`
+	Event    *time.Time        `json:"event,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Healthy    bool              `json:"healthy"`
+	Etcd       string            `json:"etcd"`
+	Watchers   []*watcherReport  `json:"watchers"`
+	Keepalived *keepalivedReport `json:"keepalived,omitempty"`
+}
+
+// agentHealth serves the agent health and the state of its watchers over HTTP
+type agentHealth struct {
+	c  *clientv3.Client
+	ka keepalivedSettings
+	// keepalived state, if keepalived events are processed
+	kaState *keepalivedState
+
+	mu      sync.Mutex
+	running map[string]*runningWatcher
+}
+
+func (h *agentHealth) setWatchers(running map[string]*runningWatcher) {
+	h.mu.Lock()
+	h.running = running
+	h.mu.Unlock()
+}
+
+// watchers returns the running watchers, which are replaced on reload
+func (h *agentHealth) watchers() []*watcher {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	watchers := make([]*watcher, 0, len(h.running))
+	for _, rw := range h.running {
+		watchers = append(watchers, rw.w)
+	}
+	return watchers
+}
+
+func (h *agentHealth) report(ctx context.Context) *healthReport {
+	rep := &healthReport{Healthy: true, Etcd: "ok", Watchers: []*watcherReport{}}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if _, err := h.c.Get(ctx, "health"); err != nil {
+		rep.Healthy, rep.Etcd = false, err.Error()
+	}
+	h.mu.Lock()
+	for _, rw := range h.running {
+		wh := rw.w.health
+		wh.mu.Lock()
+		wr := &watcherReport{Prefix: rw.w.prefix, Watching: wh.watching, agentStatus: wh.status}
+		if !wh.synced.IsZero() {
+			synced := wh.synced
+			wr.Synced = &synced
+		}
+		wh.mu.Unlock()
+		rep.Healthy = rep.Healthy && wr.Watching
+		rep.Watchers = append(rep.Watchers, wr)
+	}
+	h.mu.Unlock()
+	sort.Slice(rep.Watchers, func(i, j int) bool {
+		if rep.Watchers[i].Prefix != rep.Watchers[j].Prefix {
+			return rep.Watchers[i].Prefix < rep.Watchers[j].Prefix
+		}
+		return rep.Watchers[i].Root < rep.Watchers[j].Root
+	})
+	if s := h.kaState; s != nil {
+		s.mu.Lock()
+		rep.Keepalived = &keepalivedReport{Instance: h.ka.instance, States: make(map[string]string, len(s.states)), Error: s.err}
+		for name, state := range s.states {
+			rep.Keepalived.States[name] = state
+		}
+		if !s.event.IsZero() {
+			event := s.event
+			rep.Keepalived.Event = &event
+		}
+		s.mu.Unlock()
+	}
+	return rep
+}
+
+func (h *agentHealth) healthzHandler(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rep := h.report(r.Context())
+	if !rep.Healthy {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		if rep.Etcd != "ok" {
+			fmt.Fprintf(rw, "etcd: %s\n", rep.Etcd)
+		}
+		for _, wr := range rep.Watchers {
+			if !wr.Watching {
+				fmt.Fprintf(rw, "watcher for prefix %s root %s is not watching\n", wr.Prefix, wr.Root)
+			}
+		}
+		return
+	}
+	fmt.Fprintln(rw, "ok")
+}
+
+func (h *agentHealth) statusHandler(rw http.ResponseWriter, r *http.Request) {
+	data, err := json.MarshalIndent(h.report(r.Context()), "", "  ")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_, _ = rw.Write(append(data, '\n'))
+}
+
+// serveHTTP starts serving the handlers on the address, the server runs until closed
+func serveHTTP(addr string, handler http.Handler) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %s", addr, err)
+	}
+	srv := &http.Server{Handler: handler}
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.error("error serving HTTP", "address", addr, "error", err)
+		}
+	}()
+	return srv, nil
+}
+
+// serveAgent starts serving metrics and the agent health on the addresses they are enabled on,
+// the same address may be given for both
+func serveAgent(h *agentHealth, metricsAddr, healthAddr string) ([]*http.Server, error) {
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	if metricsAddr != "" {
+		mux(metricsAddr).HandleFunc("/metrics", metricsHandler)
+	}
+	if healthAddr != "" {
+		mux(healthAddr).HandleFunc("/healthz", h.healthzHandler)
+		mux(healthAddr).HandleFunc("/status", h.statusHandler)
+	}
+	var servers []*http.Server
+	for addr, m := range muxes {
+		srv, err := serveHTTP(addr, m)
+		if err != nil {
+			for _, srv := range servers {
+				_ = srv.Close()
+			}
+			return nil, err
+		}
+		servers = append(servers, srv)
+	}
+	return servers, nil
+}
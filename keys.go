@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// confsync keeps its own bookkeeping keys under this name right below the tree prefix,
+	// so neither put nor watch treats them as part of the synchronized tree
+	internalDirName = ".confsync"
+	hashKeyName     = ".hash"
+	metaKeyName     = ".meta"
+	generationKey   = "generation"
+	manifestKey     = "manifest"
+	statusDirName   = "status"
+)
+
+func internalKey(prefix string, elem ...string) string {
+	return path.Join(append([]string{prefix, internalDirName}, elem...)...)
+}
+
+func isInternalPath(rel string) bool {
+	return rel == internalDirName || strings.HasPrefix(rel, internalDirName+"/")
+}
+
+func isAttrName(name string) bool {
+	return name == hashKeyName || name == metaKeyName
+}
+
+func keyRelPath(prefix string, key string) (string, bool) {
+	if rel, ok := entryRelPath(prefix, key); !ok || key != prefix && isAttrName(filepath.Base(rel)) {
+		return "", false
+	} else {
+		return rel, true
+	}
+}
+
+// entryRelPath is keyRelPath for trees where entries may be named as attributes, as in format 2 trees
+// listing them in the manifest
+func entryRelPath(prefix string, key string) (string, bool) {
+	if key == prefix {
+		return filepath.Base(key), true
+	} else if rel, err := filepath.Rel(prefix, key); err != nil || strings.HasPrefix(rel, "../") || isInternalPath(rel) {
+		return "", false
+	} else {
+		return rel, true
+	}
+}
+
+// treeKeyPath splits a key into the path of the tree entry relative to the prefix and the name
+// of the entry attribute (.hash or .meta) the key holds, if any
+func treeKeyPath(prefix string, key string) (rel, attr string, ok bool) {
+	if base := path.Base(key); isAttrName(base) {
+		rel, ok = keyRelPath(prefix, path.Dir(key))
+		return rel, base, ok
+	}
+	rel, ok = keyRelPath(prefix, key)
+	return rel, "", ok
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for i, n := range logLevelNames {
+		if n == name {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("invalid log level %s", name)
+}
+
+// logger writes levelled log entries with fields given as key and value pairs, the fields common
+// to all the entries are kept in the logger; field names are prefix, root, key, revision, path and
+// error where they apply
+type logger struct {
+	fields []interface{}
+}
+
+var (
+	log = &logger{}
+
+	logMu     sync.Mutex
+	logOutput io.Writer = os.Stderr
+	logLevels           = levelInfo
+	logJSON   bool
+)
+
+// setupLogging applies --log-level and --log-format settings
+func setupLogging(level, format string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("invalid log format %s", format)
+	}
+	logLevels, logJSON = l, format == logFormatJSON
+	return nil
+}
+
+// with returns a logger adding the fields to all its entries
+func (l *logger) with(kv ...interface{}) *logger {
+	return &logger{fields: append(append([]interface{}{}, l.fields...), kv...)}
+}
+
+func (l *logger) debug(msg string, kv ...interface{}) {
+	l.write(levelDebug, msg, kv)
+}
+
+func (l *logger) info(msg string, kv ...interface{}) {
+	l.write(levelInfo, msg, kv)
+}
+
+func (l *logger) warn(msg string, kv ...interface{}) {
+	l.write(levelWarn, msg, kv)
+}
+
+func (l *logger) error(msg string, kv ...interface{}) {
+	l.write(levelError, msg, kv)
+}
+
+func (l *logger) write(level logLevel, msg string, kv []interface{}) {
+	if level < logLevels {
+		return
+	}
+	fields := append(l.fields[:len(l.fields):len(l.fields)], kv...)
+	var buf bytes.Buffer
+	if logJSON {
+		buf.WriteString(`{"time":`)
+		writeJSONValue(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSONValue(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, msg)
+		for i := 0; i < len(fields); i += 2 {
+			buf.WriteByte(',')
+			writeJSONValue(&buf, fmt.Sprint(fields[i]))
+			buf.WriteByte(':')
+			writeJSONValue(&buf, fieldValue(fields, i+1))
+		}
+		buf.WriteString("}\n")
+	} else {
+		buf.WriteString(level.String())
+		buf.WriteString(": ")
+		buf.WriteString(msg)
+		for i := 0; i < len(fields); i += 2 {
+			fmt.Fprintf(&buf, " %v=%s", fields[i], textValue(fieldValue(fields, i+1)))
+		}
+		buf.WriteByte('\n')
+	}
+	logMu.Lock()
+	_, _ = logOutput.Write(buf.Bytes())
+	logMu.Unlock()
+}
+
+// fieldValue returns the value of the field, with errors and durations as strings
+func fieldValue(fields []interface{}, i int) interface{} {
+	if i >= len(fields) {
+		return nil
+	}
+	switch v := fields[i].(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	}
+	return fields[i]
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+func textValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// log returns the logger adding the watcher prefix and root to the entries
+func (w *watcher) log() *logger {
+	return log.with("prefix", w.prefix, "root", w.root)
+}
@@ -24,12 +24,13 @@ var (
 		Use:        "confsync",
 		Short:      "A simple tool to synchronize on-disk configuration files from etcd v3 cluster",
 		SuggestFor: []string{"confsync"},
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			if globals.debug {
 				clientv3.SetLogger(grpclog.NewLoggerV2WithVerbosity(os.Stderr, os.Stderr, os.Stderr, 4))
 			} else {
 				clientv3.SetLogger(grpclog.NewLoggerV2(ioutil.Discard, ioutil.Discard, ioutil.Discard))
 			}
+			return setupLogging(globals.logLevel, globals.logFormat)
 		},
 	}
 	globals = struct {
@@ -41,6 +42,8 @@ var (
 		insecureDiscovery  bool
 		insecureSkipVerify bool
 		debug              bool
+		logLevel           string
+		logFormat          string
 		tls                struct {
 			certFile string
 			keyFile  string
@@ -57,6 +60,8 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&globals.serviceName, "discovery-srv", "", "domain `name`, the same as --domain (to keep compatible with ETCDCTL_ variables)")
 
 	rootCmd.PersistentFlags().BoolVar(&globals.debug, "debug", false, "enable client-side debug logging")
+	rootCmd.PersistentFlags().StringVar(&globals.logLevel, "log-level", levelInfo.String(), "minimum `level` of messages to log: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVar(&globals.logFormat, "log-format", logFormatText, "log `format`: text or json")
 
 	rootCmd.PersistentFlags().DurationVar(&globals.dialTimeout, "dial-timeout", defaultDialTimeout, "dial `timeout` for client connections")
 	rootCmd.PersistentFlags().DurationVar(&globals.keepAliveTime, "keepalive-time", defaultKeepAliveTime, "keepalive `time` for client connections")
@@ -74,6 +79,10 @@ func init() {
 
 	rootCmd.AddCommand(
 		newPutCommand(),
+		newDiffCommand(),
+		newKeygenCommand(),
+		newStatusCommand(),
+		newVerifyCommand(),
 		newWatchCommand(),
 		newUpdateStateCommand(),
 	)
@@ -81,8 +90,15 @@ func init() {
 	cobra.EnablePrefixMatching = true
 }
 
+// exitStatus is returned by commands which need to exit with non-zero status without reporting an error
+type exitStatus int
+
+func (s exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(s))
+}
+
 func fail(err error) {
-	_, _ = fmt.Fprintln(os.Stderr, "Error:", err)
+	log.error(err.Error())
 	os.Exit(1)
 }
 
@@ -96,6 +112,9 @@ func main() {
 		}
 	})
 	if err := rootCmd.Execute(); err != nil {
+		if status, ok := err.(exitStatus); ok {
+			os.Exit(int(status))
+		}
 		fail(err)
 	}
 }
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"go.etcd.io/etcd/clientv3"
+	"google.golang.org/grpc/grpclog"
+)
+
+// the grpc logger and the log settings are global, so they are set once rather than by each command
+// run, as clients and watchers started by tests log concurrently
+func TestMain(m *testing.M) {
+	clientv3.SetLogger(grpclog.NewLoggerV2(ioutil.Discard, ioutil.Discard, ioutil.Discard))
+	rootCmd.PersistentPreRunE = nil
+	os.Exit(m.Run())
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+const (
+	fileMetaApply  = "apply"
+	fileMetaMode   = "mode"
+	fileMetaIgnore = "ignore"
+)
+
+const (
+	entryTypeDir     = "dir"
+	entryTypeSymlink = "symlink"
+)
+
+// fileMeta is stored in the .meta key next to file content
+type fileMeta struct {
+	Type   string `json:"type,omitempty"`
+	Target string `json:"target,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	Group  string `json:"group,omitempty"`
+	// keys the content is encrypted with, and the salt of its digest
+	Keys []string `json:"keys,omitempty"`
+	Salt string   `json:"salt,omitempty"`
+}
+
+func newFileMeta(path string, info os.FileInfo, ownership bool) (*fileMeta, error) {
+	m := &fileMeta{Mode: fmt.Sprintf("%04o", info.Mode().Perm())}
+	if info.IsDir() {
+		m.Type = entryTypeDir
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading symlink %s: %s", path, err)
+		}
+		m.Type, m.Target, m.Mode = entryTypeSymlink, target, ""
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && ownership {
+		uid, gid := strconv.FormatUint(uint64(st.Uid), 10), strconv.FormatUint(uint64(st.Gid), 10)
+		if u, err := user.LookupId(uid); err == nil {
+			m.Owner = u.Username
+		} else {
+			m.Owner = uid
+		}
+		if g, err := user.LookupGroupId(gid); err == nil {
+			m.Group = g.Name
+		} else {
+			m.Group = gid
+		}
+	}
+	return m, nil
+}
+
+func decodeFileMeta(data []byte) (*fileMeta, error) {
+	m := &fileMeta{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *fileMeta) encode() []byte {
+	data, _ := json.Marshal(m)
+	return data
+}
+
+func (m *fileMeta) isDir() bool {
+	return m != nil && m.Type == entryTypeDir
+}
+
+func (m *fileMeta) isSymlink() bool {
+	return m != nil && m.Type == entryTypeSymlink
+}
+
+func (m *fileMeta) mode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(m.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q", m.Mode)
+	}
+	return os.FileMode(mode).Perm(), nil
+}
+
+// lookupUser resolves user name or numeric id to uid and primary gid
+func lookupUser(name string) (uid, gid int, err error) {
+	usr, err := user.Lookup(name)
+	if err != nil {
+		if usr, err = user.LookupId(name); err != nil {
+			return -1, -1, fmt.Errorf("no user %s found", name)
+		}
+	}
+	if uid, err = strconv.Atoi(usr.Uid); err != nil {
+		return -1, -1, fmt.Errorf("invalid user id %s of %s", usr.Uid, name)
+	}
+	if gid, err = strconv.Atoi(usr.Gid); err != nil {
+		return -1, -1, fmt.Errorf("invalid group id %s of %s", usr.Gid, name)
+	}
+	return uid, gid, nil
+}
+
+// lookupGroup resolves group name or numeric id to gid
+func lookupGroup(name string) (int, error) {
+	grp, err := user.LookupGroup(name)
+	if err != nil {
+		if grp, err = user.LookupGroupId(name); err != nil {
+			return -1, fmt.Errorf("no group %s found", name)
+		}
+	}
+	gid, err := strconv.Atoi(grp.Gid)
+	if err != nil {
+		return -1, fmt.Errorf("invalid group id %s of %s", grp.Gid, name)
+	}
+	return gid, nil
+}
+
+// fileAttrs returns mode and ownership to set on a file, taking the stored metadata or
+// the watcher root defaults, depending on --file-meta policy
+func (w *watcher) fileAttrs(path string, meta *fileMeta) (mode os.FileMode, uid, gid int) {
+	mode, uid, gid = os.FileMode(w.rootMask), w.rootOwner, w.rootGroup
+	if meta == nil || w.fileMeta == fileMetaIgnore {
+		return
+	}
+	if meta.Mode != "" {
+		if m, err := meta.mode(); err != nil {
+			w.log().warn("ignoring file mode metadata", "path", path, "error", err)
+		} else {
+			mode = m
+		}
+	}
+	if w.fileMeta != fileMetaApply {
+		return
+	}
+	if meta.Owner != "" {
+		if u, g, err := lookupUser(meta.Owner); err != nil {
+			w.log().warn("ignoring file owner metadata", "path", path, "error", err)
+		} else {
+			uid = u
+			if meta.Group == "" {
+				gid = g
+			}
+		}
+	}
+	if meta.Group != "" {
+		if g, err := lookupGroup(meta.Group); err != nil {
+			w.log().warn("ignoring file group metadata", "path", path, "error", err)
+		} else {
+			gid = g
+		}
+	}
+	return
+}
+
+// dirAttrs is the same as fileAttrs, but the default mode is derived from the root default file mode
+func (w *watcher) dirAttrs(path string, meta *fileMeta) (mode os.FileMode, uid, gid int) {
+	mode, uid, gid = w.fileAttrs(path, meta)
+	if meta == nil || meta.Mode == "" || w.fileMeta == fileMetaIgnore {
+		mode = os.FileMode(dirMode(w.rootMask))
+	}
+	return
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricCounter = "counter"
+	metricGauge   = "gauge"
+	metricSummary = "summary"
+)
+
+const (
+	commandKindReload = "reload"
+	commandKindCheck  = "check"
+)
+
+// metricVec is a metric family with values per label set, exported in Prometheus text format
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labels []string
+	value  float64
+	// observations count, for summaries
+	count uint64
+}
+
+var metricsRegistry []*metricVec
+
+var (
+	metricFilesUpdated = newMetricVec("confsync_files_updated_total", metricCounter,
+		"Files, directories and symlinks written by the watcher.", "prefix", "root")
+	metricFilesRemoved = newMetricVec("confsync_files_removed_total", metricCounter,
+		"Files, directories and symlinks removed by the watcher.", "prefix", "root")
+	metricFilesQuarantined = newMetricVec("confsync_files_quarantined_total", metricCounter,
+		"File updates not written, as their content does not match the stored digest.", "prefix", "root")
+	metricCommandRuns = newMetricVec("confsync_command_runs_total", metricCounter,
+		"Reload and check command runs.", "prefix", "root", "command")
+	metricCommandFailures = newMetricVec("confsync_command_failures_total", metricCounter,
+		"Failed reload and check command runs.", "prefix", "root", "command")
+	metricCommandDuration = newMetricVec("confsync_command_duration_seconds", metricSummary,
+		"Reload and check command run time.", "prefix", "root", "command")
+	metricAppliedRevision = newMetricVec("confsync_applied_revision", metricGauge,
+		"The last store revision applied by the watcher.", "prefix", "root")
+	metricWatchReconnects = newMetricVec("confsync_watch_reconnects_total", metricCounter,
+		"Watches restarted after the watch channel was closed.", "prefix", "root")
+	metricWatchCancellations = newMetricVec("confsync_watch_cancellations_total", metricCounter,
+		"Watches canceled or compacted, requiring full resynchronization.", "prefix", "root", "reason")
+	metricKeepalivedEvents = newMetricVec("confsync_keepalived_events_total", metricCounter,
+		"Keepalived events processed.", "kind", "state")
+	metricTxnErrors = newMetricVec("confsync_etcd_txn_errors_total", metricCounter,
+		"Failed etcd requests.", "op")
+)
+
+func newMetricVec(name, kind, help string, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]*metricValue)}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+func (m *metricVec) value(labels []string) *metricValue {
+	if len(labels) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: %d label values given, %d expected", m.name, len(labels), len(m.labels)))
+	}
+	key := strings.Join(labels, "\x00")
+	v, ok := m.values[key]
+	if !ok {
+		v = &metricValue{labels: labels}
+		m.values[key] = v
+	}
+	return v
+}
+
+func (m *metricVec) add(delta float64, labels ...string) {
+	m.mu.Lock()
+	m.value(labels).value += delta
+	m.mu.Unlock()
+}
+
+func (m *metricVec) inc(labels ...string) {
+	m.add(1, labels...)
+}
+
+func (m *metricVec) set(value float64, labels ...string) {
+	m.mu.Lock()
+	m.value(labels).value = value
+	m.mu.Unlock()
+}
+
+func (m *metricVec) observe(value float64, labels ...string) {
+	m.mu.Lock()
+	v := m.value(labels)
+	v.value += value
+	v.count++
+	m.mu.Unlock()
+}
+
+// delete removes the values of the label sets starting with the given label values
+func (m *metricVec) delete(labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+Values:
+	for key, v := range m.values {
+		for i, label := range labels {
+			if v.labels[i] != label {
+				continue Values
+			}
+		}
+		delete(m.values, key)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricVec) labelString(values []string) string {
+	pairs := make([]string, len(values))
+	for i, value := range values {
+		pairs[i] = m.labels[i] + `="` + labelValueEscaper.Replace(value) + `"`
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := m.values[key]
+		labels := m.labelString(v.labels)
+		if m.kind == metricSummary {
+			fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", m.name, labels, v.value, m.name, labels, v.count)
+		} else {
+			fmt.Fprintf(w, "%s%s %g\n", m.name, labels, v.value)
+		}
+	}
+}
+
+func writeMetrics(w io.Writer) {
+	for _, m := range metricsRegistry {
+		m.write(w)
+	}
+}
+
+func metricsHandler(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(rw)
+}
+
+// recordChanges counts the entries written and removed in the watcher root
+func (w *watcher) recordChanges(changes *treeChanges) {
+	metricFilesUpdated.add(float64(len(changes.updated)), w.prefix, w.root)
+	metricFilesRemoved.add(float64(len(changes.removed)), w.prefix, w.root)
+}
+
+// deleteMetrics removes the series of the watcher, once it's stopped for good
+func (w *watcher) deleteMetrics() {
+	for _, m := range metricsRegistry {
+		if len(m.labels) >= 2 && m.labels[0] == "prefix" && m.labels[1] == "root" {
+			m.delete(w.prefix, w.root)
+		}
+	}
+}
+
+// recordCommandRun counts the command run, of reload or check kind
+func (w *watcher) recordCommandRun(kind string, start time.Time, err error) {
+	metricCommandRuns.inc(w.prefix, w.root, kind)
+	metricCommandDuration.observe(time.Since(start).Seconds(), w.prefix, w.root, kind)
+	if err != nil {
+		metricCommandFailures.inc(w.prefix, w.root, kind)
+	}
+}
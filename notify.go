@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const notifyStatusInterval = 10 * time.Second
+
+// sdNotifier notifies systemd of the agent state over the NOTIFY_SOCKET datagram protocol
+type sdNotifier struct {
+	socket   string
+	watchdog time.Duration
+}
+
+// newSdNotifier takes the notification socket and the watchdog interval from the environment, and
+// removes them, so commands run by the agent can't notify on its behalf; it returns nil if the agent
+// is not run by systemd with Type=notify
+func newSdNotifier() *sdNotifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	n := &sdNotifier{socket: socket}
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		if pid := os.Getenv("WATCHDOG_PID"); pid == "" || pid == strconv.Itoa(os.Getpid()) {
+			n.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	for _, name := range []string{"NOTIFY_SOCKET", "WATCHDOG_USEC", "WATCHDOG_PID"} {
+		_ = os.Unsetenv(name)
+	}
+	return n
+}
+
+func (n *sdNotifier) notify(state string) {
+	name := n.socket
+	if name[0] == '@' {
+		// abstract socket
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err == nil {
+		_, err = conn.Write([]byte(state))
+		_ = conn.Close()
+	}
+	if err != nil {
+		log.warn("error notifying systemd", "error", err)
+	}
+}
+
+// run sends READY=1 once the running watchers are ready, then keeps the status text up to date and
+// notifies the watchdog while the agent is healthy, until stopped
+func (n *sdNotifier) run(h *agentHealth, stop chan struct{}) {
+	// watchers may be replaced on reload while waiting, stopped ones are ready as well
+	for waited := true; waited; {
+		waited = false
+		for _, w := range h.watchers() {
+			select {
+			case <-w.ready:
+				continue
+			default:
+			}
+			waited = true
+			select {
+			case <-w.ready:
+			case <-stop:
+				return
+			}
+		}
+	}
+	rep := h.report(context.Background())
+	n.notify("READY=1\nSTATUS=" + statusText(rep))
+	interval := notifyStatusInterval
+	if n.watchdog > 0 && n.watchdog/2 < interval {
+		interval = n.watchdog / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		rep = h.report(context.Background())
+		state := "STATUS=" + statusText(rep)
+		if n.watchdog > 0 && rep.Healthy {
+			state = "WATCHDOG=1\n" + state
+		}
+		n.notify(state)
+	}
+}
+
+// statusText summarizes the last applied revision of each watcher in a single line
+func statusText(rep *healthReport) string {
+	var parts []string
+	if rep.Etcd != "ok" {
+		parts = append(parts, "etcd unreachable")
+	}
+	for _, wr := range rep.Watchers {
+		part := fmt.Sprintf("%s at %d", wr.Prefix, wr.Revision)
+		if !wr.Watching {
+			part += " (not watching)"
+		} else if wr.Unhealthy {
+			part += " (unhealthy)"
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "no watchers"
+	}
+	return strings.Join(parts, ", ")
+}
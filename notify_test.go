@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+func readNotification(t *testing.T, conn *net.UnixConn, timeout time.Duration) (string, bool) {
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return "", false
+		}
+		t.Fatal(err)
+	}
+	return string(buf[:n]), true
+}
+
+func TestSdNotifier(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	os.Setenv("WATCHDOG_USEC", "200000")
+	n := newSdNotifier()
+	if n == nil || n.socket != socket || n.watchdog != 200*time.Millisecond {
+		t.Fatalf("notifier is not set up from the environment: %+v", n)
+	} else if os.Getenv("NOTIFY_SOCKET") != "" || os.Getenv("WATCHDOG_USEC") != "" {
+		t.Fatal("systemd environment is not removed")
+	}
+
+	c, err := clientv3.New(clientv3.Config{Endpoints: []string{startEtcd(t)}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	newTestWatcher := func(prefix string) *runningWatcher {
+		return &runningWatcher{w: &watcher{prefix: prefix, health: &watcherHealth{watching: true}, ready: make(chan struct{})}}
+	}
+	a, b := newTestWatcher("/a"), newTestWatcher("/b")
+	h := &agentHealth{c: c}
+	h.setWatchers(map[string]*runningWatcher{"a": a})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.run(h, stop)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	// a watcher added on reload is waited for as well
+	h.setWatchers(map[string]*runningWatcher{"a": a, "b": b})
+	close(a.w.ready)
+	if state, ok := readNotification(t, conn, 300*time.Millisecond); ok {
+		t.Fatalf("notified before all the watchers are ready: %q", state)
+	}
+	close(b.w.ready)
+	state, ok := readNotification(t, conn, 5*time.Second)
+	if !ok {
+		t.Fatal("READY=1 is not sent")
+	} else if state != "READY=1\nSTATUS=/a at 0, /b at 0" {
+		t.Fatalf("unexpected notification %q", state)
+	}
+	if state, ok = readNotification(t, conn, 5*time.Second); !ok {
+		t.Fatal("watchdog is not notified")
+	} else if !strings.HasPrefix(state, "WATCHDOG=1\nSTATUS=") {
+		t.Fatalf("unexpected notification %q", state)
+	}
+
+	// the status follows watchers removed on reload
+	h.setWatchers(map[string]*runningWatcher{"b": b})
+	for deadline := time.Now().Add(5 * time.Second); state != "WATCHDOG=1\nSTATUS=/b at 0"; {
+		if state, ok = readNotification(t, conn, time.Until(deadline)); !ok {
+			t.Fatalf("status of the removed watcher is still reported: %q", state)
+		}
+	}
+}
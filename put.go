@@ -1,22 +1,47 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha512"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"github.com/golang/snappy"
 	"github.com/sabhiram/go-gitignore"
 	"github.com/spf13/cobra"
 	"go.etcd.io/etcd/clientv3"
 	"hash"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
+)
+
+const (
+	defaultMaxTxnOps   = 128
+	defaultMaxTxnBytes = 1024 * 1024
+	defaultPutWait     = 5 * time.Minute
+)
+
+var (
+	putMaxTxnOps   int
+	putMaxTxnBytes int
+	putDryRun      bool
+	putUnified     bool
+	putOwnership   bool
+	putWait        time.Duration
+	putEncryptKeys []string
+	putRecipients  []string
+	// set from --encrypt-key and --recipient
+	putEncryption *contentEncryption
+	putSignKey    string
+	putSigner     *manifestSigner
+	// --format, resolved to the format to store once negotiated with the agents
+	putFormat string
 )
 
 func newPutCommand() *cobra.Command {
@@ -31,12 +56,49 @@ working directory as well.
 
 put command will only update files if their content differ from those already stored. 
 
-put command updates files in a single transaction. Since etcd limits both number of operations in a single
-transaction and request limit, put command can handle about 40 files of totals size about 1 Mb (which
-should be enough for most services).
+put command stores file permissions (and, with --ownership, owner and group names) as file metadata,
+which is applied by watch command. Directories (including empty ones) and symbolic links are stored as
+separate entries, symbolic links are never followed.
+
+put command splits the update into a number of transactions, each within --max-txn-ops operations and
+--max-txn-bytes bytes (those should match etcd server --max-txn-ops and --max-request-bytes settings).
+Once all the transactions are committed, put command updates the tree generation key, so watchers can
+tell a partially uploaded tree from a complete one. The tree manifest is written along with the
+generation in a single request, put command fails before updating anything if it exceeds --max-txn-bytes.
 
 If no directory given, put will synchronize content of current one.
 
+Along with the generation, put command stores the tree manifest listing the digest, size and metadata
+of every file, and the tree format. Format 2 trees are only read by format 2 watchers, which take file
+digests and metadata from the manifest; with --format=compat, put command also stores them in .hash
+and .meta keys next to each file, as format 1 watchers expect. With --format=auto, put command stores
+the tree in format 2 once every agent reporting its status for the prefix supports it (see watch
+--status-ttl), and in the compatible format otherwise. Watchers refuse trees stored in a newer format
+than they support. Files named .hash or .meta are stored in format 2 trees as any other, and skipped
+in the compatible format, where the names are reserved.
+
+put command compresses file content with --compression codec: snappy, which format 1 watchers read,
+gzip, zstd or none (format 2 only), or with auto (the default), zstd for files it shrinks and no
+compression for small ones in format 2 trees, and snappy in the compatible format. The codec is
+recorded in each stored value, so watchers decode values stored with any codec, and files put does
+not update keep the codec they are stored with.
+
+With --encrypt-key or --recipient, file content is encrypted before it's stored, with a random key
+wrapped with each shared secret key and for each recipient public key given (see keygen command),
+so watch agents can only decrypt it with one of the keys (see watch --decrypt-key). File names and
+metadata are stored in clear, and the digests of encrypted files are salted.
+
+With --sign-key, put command signs the tree manifest, so watch agents with --trusted-keys apply the
+tree only if its manifest is signed with one of the keys and every file matches it. The manifest is
+updated even if no file has changed.
+
+With --wait, put command waits until every watch agent reporting its status for the prefix (see
+status command) applies the tree, and exits with non-zero status if any of them fails to, is gone,
+or does not apply it within the timeout (5m if not given).
+
+With --dry-run, put command only reports files that would be added, updated or removed (and with
+--unified, the changes of their content), and exits with non-zero status if there are any.
+
 Example:
 
 confsync put /etc/firewall/keepalived
@@ -45,6 +107,17 @@ confsync put /etc/firewall/keepalived
 		RunE: putCommandFunc,
 		Args: cobra.RangeArgs(1, 2),
 	}
+	cmd.Flags().IntVar(&putMaxTxnOps, "max-txn-ops", defaultMaxTxnOps, "maximum `number` of operations in a single transaction")
+	cmd.Flags().IntVar(&putMaxTxnBytes, "max-txn-bytes", defaultMaxTxnBytes, "maximum `size` of a single transaction request")
+	cmd.Flags().BoolVar(&putOwnership, "ownership", false, "record file owner and group names along with file modes")
+	cmd.Flags().BoolVarP(&putDryRun, "dry-run", "n", false, "only report changes, do not update the store")
+	cmd.Flags().BoolVarP(&putUnified, "unified", "u", false, "show unified diff of changed files (with --dry-run)")
+	addEncryptionFlags(cmd)
+	addFormatFlag(cmd)
+	addCompressionFlag(cmd)
+	cmd.Flags().StringVar(&putSignKey, "sign-key", "", "signing key `file` to sign the tree manifest with (see keygen --sign)")
+	cmd.Flags().DurationVar(&putWait, "wait", 0, "wait up to `timeout` for all watch agents to apply the tree")
+	cmd.Flags().Lookup("wait").NoOptDefVal = defaultPutWait.String()
 	return cmd
 }
 
@@ -73,7 +146,7 @@ type treeIgnoreMatcher struct {
 
 func newTreeIgnoreMatcher(root string) *treeIgnoreMatcher {
 	var im = &treeIgnoreMatcher{
-		root: root,
+		root:  root,
 		local: make(map[string]confIgnoreMatcher),
 	}
 	if u, err := user.Current(); err == nil {
@@ -97,14 +170,14 @@ func (tim *treeIgnoreMatcher) addPath(path string) {
 	if fi, err := os.Stat(fp); err == nil && !fi.IsDir() {
 		cim.confIgnore, err = ignore.CompileIgnoreFile(fp)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error compiling ignore file %s: %s\n", fp, err)
+			log.warn("error compiling ignore file", "path", fp, "error", err)
 		}
 	}
 	fp = filepath.Join(path, ".gitignore")
 	if fi, err := os.Stat(fp); err == nil && !fi.IsDir() {
 		cim.gitIgnore, _ = ignore.CompileIgnoreFile(fp)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error compiling ignore file %s: %s\n", fp, err)
+			log.warn("error compiling ignore file", "path", fp, "error", err)
 		}
 	}
 	if cim.confIgnore != nil || cim.gitIgnore != nil {
@@ -143,57 +216,187 @@ func newHash() hash.Hash {
 
 func putCommandFunc(cmd *cobra.Command, args []string) error {
 	var root string
+	if putMaxTxnOps <= 0 || putMaxTxnBytes <= 0 {
+		return fmt.Errorf("transaction limits must be positive")
+	}
 	if len(args) > 1 {
 		root = args[1]
 	}
-	return updateTreeRecursively(mustClient(), args[0], root)
+	var err error
+	if err = validateFormat(putFormat); err != nil {
+		return err
+	} else if err = validateCompression(putCompression); err != nil {
+		return err
+	} else if putEncryption, err = loadContentEncryption(putEncryptKeys, putRecipients); err != nil {
+		return err
+	} else if putSigner, err = loadManifestSigner(putSignKey); err != nil {
+		return err
+	}
+	if putDryRun {
+		return diffTree(cmd, mustClient(), args[0], root, putUnified)
+	} else if putUnified {
+		return errors.New("--unified is only supported with --dry-run")
+	} else if putWait < 0 {
+		return errors.New("--wait timeout can't be negative")
+	}
+	c := mustClient()
+	if err := updateTreeRecursively(c, args[0], root); err != nil {
+		return err
+	} else if putWait > 0 {
+		return waitForAgents(cmd, c, args[0], putWait)
+	}
+	return nil
 }
 
-func getFile(path string) (data, hash []byte, err error) {
-	f, err := os.OpenFile(path, os.O_RDONLY, 0)
-	if err != nil {
-		return
+func encodeContent(content []byte, compression string) (data, hash []byte, err error) {
+	if data, err = compressContent(content, compression); err != nil {
+		return nil, nil, err
 	}
-	defer f.Close()
+	return data, contentDigest(nil, content), nil
+}
+
+// contentDigest returns the hex digest of the content, salted if the content is stored encrypted
+func contentDigest(salt, content []byte) []byte {
 	h := newHash()
-	data, err = ioutil.ReadAll(io.TeeReader(f, h))
-	if err != nil {
-		return
-	}
-	data = snappy.Encode(nil, data)
+	h.Write(salt)
+	h.Write(content)
 	s := h.Sum([]byte{})
-	hash = make([]byte, hex.EncodedLen(len(s)))
+	hash := make([]byte, hex.EncodedLen(len(s)))
 	hex.Encode(hash, s)
-	return
+	return hash
 }
 
-type opDesc struct {
-	path  string
-	isDel bool
+type change struct {
+	key    string
+	path   string
+	isNew  bool
+	isDel  bool
+	data   []byte
+	digest []byte
+	meta   []byte
+	// .hash and .meta keys are stored for format 1 watchers along with the content, otherwise the stale
+	// ones are removed, and with dropAttrs only they are
+	attrs      bool
+	dropAttrs  bool
+	staleAttrs []string
 }
 
-func updateTreeRecursively(c clientv3.KV, prefix, root string) error {
+// rough per-operation overhead of the protobuf encoding, used to keep batches under --max-txn-bytes
+const txnOpOverhead = 32
+
+func (ch *change) op() clientv3.Op {
+	hashKey, metaKey := path.Join(ch.key, hashKeyName), path.Join(ch.key, metaKeyName)
+	if ch.isDel || ch.dropAttrs || !ch.attrs {
+		var ops []clientv3.Op
+		if ch.isDel {
+			ops = append(ops, clientv3.OpDelete(ch.key))
+		} else if !ch.dropAttrs {
+			ops = append(ops, clientv3.OpPut(ch.key, string(ch.data)))
+		}
+		for _, key := range ch.staleAttrs {
+			ops = append(ops, clientv3.OpDelete(key))
+		}
+		return clientv3.OpTxn([]clientv3.Cmp{}, ops, []clientv3.Op{})
+	}
+	return clientv3.OpTxn(
+		[]clientv3.Cmp{
+			clientv3.Compare(clientv3.CreateRevision(ch.key), "!=", 0),
+			clientv3.Compare(clientv3.CreateRevision(hashKey), "!=", 0),
+			clientv3.Compare(clientv3.Value(hashKey), "=", string(ch.digest)),
+			clientv3.Compare(clientv3.Value(metaKey), "=", string(ch.meta)),
+		},
+		[]clientv3.Op{},
+		[]clientv3.Op{
+			clientv3.OpPut(ch.key, string(ch.data)),
+			clientv3.OpPut(hashKey, string(ch.digest)),
+			clientv3.OpPut(metaKey, string(ch.meta)),
+		},
+	)
+}
+
+func (ch *change) size() int {
+	return 6*(len(ch.key)+len(metaKeyName)+txnOpOverhead) + len(ch.data) + 2*(len(ch.digest)+len(ch.meta))
+}
+
+func getValues(c clientv3.KV, keys []string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > putMaxTxnOps {
+			n = putMaxTxnOps
+		}
+		ops := make([]clientv3.Op, n)
+		for i := range ops {
+			ops[i] = clientv3.OpGet(keys[i])
+		}
+		resp, err := c.Txn(context.Background()).If().Then(ops...).Commit()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Responses {
+			if r := r.GetResponseRange(); r != nil {
+				for _, kv := range r.Kvs {
+					values[string(kv.Key)] = kv.Value
+				}
+			}
+		}
+		keys = keys[n:]
+	}
+	return values, nil
+}
+
+// planTree compares the local tree with the stored one, and returns the changes to store along with
+// the manifest of the local tree
+func planTree(c clientv3.KV, prefix, root string) ([]*change, *treeManifest, error) {
 	var (
-		tree    = make(map[string]bool)
-		ops     = make([]clientv3.Op, 0, 8)
-		opsDesc = make([]opDesc, 0, 8)
-		gi      *treeIgnoreMatcher
-		cwd     string
-		err     error
+		tree     = make(map[string]bool)
+		attrKeys []string
+		changes  []*change
+		manifest = newTreeManifest(prefix)
+		gi       *treeIgnoreMatcher
+		cwd      string
+		err      error
 	)
 	if cwd, err = os.Getwd(); err != nil {
-		return fmt.Errorf("error getting current directory: %s", err)
+		return nil, nil, fmt.Errorf("error getting current directory: %s", err)
+	}
+	format, err := negotiateFormat(c, putFormat, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	compression, err := treeCompression(putCompression, format)
+	if err != nil {
+		return nil, nil, err
 	}
+	// entries of format 2 trees are compared with the stored manifest, legacy ones with .hash and .meta keys
+	var sm *treeManifest
+	if value, err := storedManifest(context.Background(), c, prefix); err != nil {
+		return nil, nil, err
+	} else if value != nil {
+		if sm, err = decodeManifest(prefix, value, nil); err != nil {
+			log.warn("ignoring stored tree manifest", "prefix", prefix, "error", err)
+		}
+	}
+	// .hash and .meta names are only reserved for attribute keys in trees format 1 watchers read
+	reserved := format == formatCompat
 	resp, err := c.Get(context.Background(), path.Join(prefix, "/"), clientv3.WithPrefix(), clientv3.WithKeysOnly())
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	for _, kv := range resp.Kvs {
 		key := string(kv.Key)
-		if path.Base(key) != ".hash" {
-			tree[string(kv.Key)] = true
+		if rel, ok := entryRelPath(prefix, key); ok && !reserved && sm.entry(rel) != nil {
+			tree[key] = true
+		} else if isAttrName(path.Base(key)) {
+			attrKeys = append(attrKeys, key)
+		} else if ok {
+			tree[key] = true
 		}
 	}
+	attrs, err := getValues(c, attrKeys)
+	if err != nil {
+		return nil, nil, err
+	}
 	if root == "" {
 		root = cwd
 		gi = newTreeIgnoreMatcher(root)
@@ -202,7 +405,7 @@ func updateTreeRecursively(c clientv3.KV, prefix, root string) error {
 	} else {
 		root = filepath.Join(cwd, root)
 		if rel, err := filepath.Rel(cwd, root); err != nil {
-			return fmt.Errorf("error getting source directory: %s", err)
+			return nil, nil, fmt.Errorf("error getting source directory: %s", err)
 		} else if strings.HasPrefix(rel, "../") {
 			gi = newTreeIgnoreMatcher(root)
 		} else {
@@ -214,6 +417,15 @@ func updateTreeRecursively(c clientv3.KV, prefix, root string) error {
 		if info == nil {
 			return fmt.Errorf("%s does not exist", p)
 		}
+		rel, _ := filepath.Rel(root, p)
+		if isInternalPath(rel) || reserved && isAttrName(info.Name()) {
+			log.warn("skipping file, the name is reserved by confsync", "path", p)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		var content []byte
 		if info.IsDir() {
 			if info.Name() == ".git" {
 				return filepath.SkipDir
@@ -221,64 +433,206 @@ func updateTreeRecursively(c clientv3.KV, prefix, root string) error {
 				return filepath.SkipDir
 			}
 			gi.addPath(p)
+			if rel == "." {
+				return nil
+			}
+			// directories and symlinks are stored with empty content, metadata describes them
+		} else if info.Name() == ".gitignore" || info.Name() == ".confignore" || gi.Match(p, false) {
 			return nil
-		}
-		if info.Name() == ".gitignore" || info.Name() == ".confignore" || gi.Match(p, false) {
+		} else if info.Mode()&os.ModeSymlink != 0 {
+		} else if !info.Mode().IsRegular() {
+			log.warn("skipping file, not a regular file", "path", p)
 			return nil
+		} else if content, err = ioutil.ReadFile(p); err != nil {
+			return fmt.Errorf("error reading file %s: %s", p, err)
 		}
-		data, digest, err := getFile(p)
+		fm, err := newFileMeta(p, info, putOwnership)
 		if err != nil {
-			return fmt.Errorf("error reading file %s: %s", p, err)
+			return err
 		}
-		rel, _ := filepath.Rel(root, p)
 		key := filepath.Join(prefix, rel)
-		hashKey := filepath.Join(key, ".hash")
+		// encrypted content is bound to its path relative to the prefix, as the watchers see it
+		keyRel, _ := entryRelPath(prefix, key)
+		hashKey, metaKey := path.Join(key, hashKeyName), path.Join(key, metaKeyName)
+		var prev *fileMeta
+		if e := sm.entry(keyRel); e != nil {
+			prev = e.meta()
+		} else if v, ok := attrs[metaKey]; ok {
+			prev, _ = decodeFileMeta(v)
+		}
+		data, digest, err := putEncryption.encode(keyRel, content, fm, prev, compression)
+		if err != nil {
+			return fmt.Errorf("error encoding file %s: %s", p, err)
+		}
+		meta := fm.encode()
+		manifest.add(keyRel, digest, len(content), fm)
+		_, stored := tree[key]
 		delete(tree, key)
-		ops = append(ops, clientv3.OpTxn(
-			[]clientv3.Cmp{
-				clientv3.Compare(clientv3.CreateRevision(key), "!=", 0),
-				clientv3.Compare(clientv3.CreateRevision(hashKey), "!=", 0),
-				clientv3.Compare(clientv3.Value(hashKey), "=", string(digest)),
-			},
-			[]clientv3.Op{},
-			[]clientv3.Op{
-				clientv3.OpPut(key, string(data)),
-				clientv3.OpPut(hashKey, string(digest)),
-			},
-		))
-		opsDesc = append(opsDesc, opDesc{path: key})
+		_, hasAttrs := attrs[hashKey]
+		attrsMatch := hasAttrs && bytes.Equal(attrs[hashKey], digest) && bytes.Equal(attrs[metaKey], meta)
+		ch := &change{key: key, path: p, isNew: !stored, data: data, digest: digest, meta: meta, attrs: format == formatCompat}
+		if format == formatCompat {
+			if stored && attrsMatch {
+				return nil
+			}
+		} else if e := sm.entry(keyRel); stored && (e != nil && e.Hash == string(digest) && bytes.Equal(e.meta().encode(), meta) || sm == nil && attrsMatch) {
+			if _, hasMeta := attrs[metaKey]; hasAttrs || hasMeta {
+				// migrated to format 2
+				ch.dropAttrs = true
+				changes = append(changes, ch)
+			}
+			return nil
+		}
+		changes = append(changes, ch)
 		return nil
 	}); err != nil {
-		return err
+		return nil, nil, err
 	}
+	removed := make([]string, 0, len(tree))
 	for key := range tree {
 		rel, _ := filepath.Rel(prefix, key)
 		if !gi.Match(filepath.Join(root, rel), false) {
-			ops = append(ops, clientv3.OpTxn(
-				[]clientv3.Cmp{},
-				[]clientv3.Op{
-					clientv3.OpDelete(key),
-					clientv3.OpDelete(path.Join(key, ".hash")),
-				},
-				[]clientv3.Op{},
-			))
-			opsDesc = append(opsDesc, opDesc{path: key, isDel: true})
-		}
-	}
-	tresp, err := c.Txn(context.Background()).If().Then(ops...).Commit()
+			removed = append(removed, key)
+		} else if err := carryOver(prefix, key, sm, attrs, manifest); err != nil {
+			return nil, nil, err
+		} else if putSigner != nil {
+			log.warn("stored file is ignored locally, it is signed as stored", "key", key)
+		}
+	}
+	sort.Strings(removed)
+	for _, key := range removed {
+		rel, _ := filepath.Rel(prefix, key)
+		changes = append(changes, &change{key: key, path: filepath.Join(root, rel), isDel: true})
+	}
+	// legacy attribute keys are removed along with their entries, unless they are entries of the tree now
+	planned := changes[:0]
+	for _, ch := range changes {
+		for _, key := range []string{path.Join(ch.key, hashKeyName), path.Join(ch.key, metaKeyName)} {
+			if _, ok := attrs[key]; ok {
+				if rel, _ := entryRelPath(prefix, key); manifest.entry(rel) == nil {
+					ch.staleAttrs = append(ch.staleAttrs, key)
+				}
+			}
+		}
+		if !ch.dropAttrs || len(ch.staleAttrs) > 0 {
+			planned = append(planned, ch)
+		}
+	}
+	return planned, manifest, nil
+}
+
+func batchChanges(changes []*change) ([][]*change, error) {
+	var (
+		batches [][]*change
+		batch   []*change
+		size    int
+	)
+	for _, ch := range changes {
+		sz := ch.size()
+		if sz > putMaxTxnBytes {
+			return nil, fmt.Errorf("%s is too large to fit in a single transaction (about %d bytes, limit is %d)", ch.key, sz, putMaxTxnBytes)
+		}
+		if len(batch) > 0 && (len(batch) >= putMaxTxnOps || size+sz > putMaxTxnBytes) {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, ch)
+		size += sz
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+func applyChanges(c clientv3.KV, prefix string, changes []*change, manifest *treeManifest) error {
+	batches, err := batchChanges(changes)
 	if err != nil {
 		return err
 	}
-	for i, r := range tresp.Responses {
-		if r := r.GetResponseTxn(); r != nil {
-			if opsDesc[i].isDel {
+	// the manifest is published in a single request after all the batches, so it's checked before any
+	value, err := manifest.encode(putSigner)
+	if err != nil {
+		return fmt.Errorf("error encoding tree manifest: %s", err)
+	} else if sz := manifestTxnSize(prefix, value); sz > putMaxTxnBytes {
+		return fmt.Errorf("tree manifest is too large to fit in a single transaction (about %d bytes for %d entries, limit is %d)", sz, len(manifest.Entries), putMaxTxnBytes)
+	}
+	cnt := 0
+	for i, batch := range batches {
+		ops := make([]clientv3.Op, len(batch))
+		for j, ch := range batch {
+			ops[j] = ch.op()
+		}
+		tresp, err := c.Txn(context.Background()).If().Then(ops...).Commit()
+		if err != nil {
+			if i > 0 {
+				return fmt.Errorf("error committing batch %d of %d, the tree is partially updated and its generation is not published: %s", i+1, len(batches), err)
+			}
+			return err
+		}
+		// changed keys are the command output, so they are reported on stdout rather than logged
+		log.debug("committed batch", "prefix", prefix, "batch", i+1, "batches", len(batches), "revision", tresp.Header.Revision)
+		for j, r := range tresp.Responses {
+			r, ch := r.GetResponseTxn(), batch[j]
+			if r == nil {
+				continue
+			}
+			switch {
+			case ch.isDel:
 				if r.Succeeded {
-					fmt.Printf("removed %s\n", opsDesc[i].path)
+					fmt.Printf("removed %s\n", ch.key)
+					cnt++
 				}
-			} else if !r.Succeeded {
-				fmt.Printf("updated %s\n", opsDesc[i].path)
+			case ch.dropAttrs:
+				log.info("removed legacy .hash and .meta keys", "prefix", prefix, "key", ch.key, "revision", tresp.Header.Revision)
+				cnt++
+			case !ch.attrs || !r.Succeeded:
+				fmt.Printf("updated %s\n", ch.key)
+				cnt++
 			}
 		}
 	}
+	publish := cnt > 0
+	if !publish {
+		if publish, err = manifestChanged(c, prefix, value); err != nil {
+			return fmt.Errorf("error reading tree manifest: %s", err)
+		}
+	}
+	if publish {
+		// generation key is always written last: watchers consider the tree complete only once it's updated
+		rev, err := publishGeneration(c, prefix, value)
+		if err != nil {
+			return fmt.Errorf("error publishing tree generation: %s", err)
+		}
+		if putSigner != nil {
+			log.info("published signed tree manifest", "prefix", prefix, "signing_key", putSigner.id, "revision", rev)
+		}
+		log.info("published tree generation", "prefix", prefix, "format", manifest.Format, "revision", rev)
+	}
 	return nil
 }
+
+// carryOver lists the stored entry, which is kept in the store as it's ignored locally, in the manifest
+// as stored; the content is not decoded, as it may be encrypted for recipients only, so the size of
+// entries of trees stored without a manifest is unknown
+func carryOver(prefix, key string, sm *treeManifest, attrs map[string][]byte, manifest *treeManifest) error {
+	rel, _ := entryRelPath(prefix, key)
+	if e := sm.entry(rel); e != nil {
+		manifest.Entries[rel] = e
+		return nil
+	}
+	meta, err := decodeFileMeta(attrs[path.Join(key, metaKeyName)])
+	if err != nil {
+		return fmt.Errorf("stored file %s is ignored locally, and its metadata can't be listed in the manifest: %s", key, err)
+	}
+	manifest.add(rel, attrs[path.Join(key, hashKeyName)], unknownSize, meta)
+	return nil
+}
+
+func updateTreeRecursively(c clientv3.KV, prefix, root string) error {
+	changes, manifest, err := planTree(c, prefix, root)
+	if err != nil {
+		return err
+	}
+	return applyChanges(c, prefix, changes, manifest)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+func TestPutCarriesOverIgnoredRecipientOnlyFile(t *testing.T) {
+	endpoint := startEtcd(t)
+	c, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	keyFile := filepath.Join(t.TempDir(), "content.key")
+	if err := runConfsync("keygen", keyFile); err != nil {
+		t.Fatal(err)
+	}
+	e, err := loadContentEncryption(nil, []string{keyFile + ".pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a.conf is stored encrypted for the recipient only, in a tree stored without a manifest
+	meta := &fileMeta{Mode: "0644"}
+	data, digest, err := e.encode("a.conf", []byte("secret\n"), meta, nil, compressionSnappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Txn(context.Background()).Then(
+		clientv3.OpPut("/legacy/a.conf", string(data)),
+		clientv3.OpPut("/legacy/a.conf/.hash", string(digest)),
+		clientv3.OpPut("/legacy/a.conf/.meta", string(meta.encode())),
+	).Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	src := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, ".confignore"), []byte("a.conf\n"), 0644); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(filepath.Join(src, "b.conf"), []byte("b = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runConfsync("put", "-e", endpoint, "--format", formatLatest, "/legacy", src); err != nil {
+		t.Fatalf("put with the ignored file: %s", err)
+	}
+	resp, err := c.Get(context.Background(), "/legacy/a.conf")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != string(data) {
+		t.Fatal("ignored file is not kept as stored")
+	}
+	value, err := storedManifest(context.Background(), c, "/legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := decodeManifest("/legacy", value, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := m.entry("a.conf"); e == nil || e.Hash != string(digest) || e.Size != unknownSize || len(e.Keys) != 1 {
+		t.Fatalf("unexpected manifest entry of the ignored file: %+v", e)
+	} else if e = m.entry("b.conf"); e == nil || e.Size != 6 {
+		t.Fatalf("unexpected manifest entry of b.conf: %+v", e)
+	}
+}
+
+// captureStdout returns what the function writes to stdout
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- data
+	}()
+	f()
+	os.Stdout = stdout
+	_ = w.Close()
+	return string(<-out)
+}
+
+func TestPutReportsChangesOnStdout(t *testing.T) {
+	endpoint := startEtcd(t)
+	src := t.TempDir()
+	for _, name := range []string{"a.conf", "b.conf"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var err error
+	out := captureStdout(t, func() { err = runConfsync("put", "-e", endpoint, "/report", src) })
+	if err != nil {
+		t.Fatal(err)
+	} else if out != "updated /report/a.conf\nupdated /report/b.conf\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	if err := os.Remove(filepath.Join(src, "b.conf")); err != nil {
+		t.Fatal(err)
+	}
+	out = captureStdout(t, func() { err = runConfsync("put", "-e", endpoint, "/report", src) })
+	if err != nil {
+		t.Fatal(err)
+	} else if out != "removed /report/b.conf\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestBatchChanges(t *testing.T) {
+	defer func(ops, bytes int) { putMaxTxnOps, putMaxTxnBytes = ops, bytes }(putMaxTxnOps, putMaxTxnBytes)
+	changes := make([]*change, 5)
+	for i := range changes {
+		changes[i] = &change{key: fmt.Sprintf("/test/%d.conf", i), data: make([]byte, 100)}
+	}
+	sz := changes[0].size()
+	for _, tc := range []struct {
+		ops, bytes int
+		sizes      []int
+	}{
+		{10, 10 * sz, []int{5}},
+		{2, 10 * sz, []int{2, 2, 1}},
+		{10, 2*sz + 1, []int{2, 2, 1}},
+		{10, sz, []int{1, 1, 1, 1, 1}},
+	} {
+		putMaxTxnOps, putMaxTxnBytes = tc.ops, tc.bytes
+		batches, err := batchChanges(changes)
+		if err != nil {
+			t.Fatalf("ops %d, bytes %d: %s", tc.ops, tc.bytes, err)
+		}
+		sizes := make([]int, len(batches))
+		for i, batch := range batches {
+			sizes[i] = len(batch)
+		}
+		if !reflect.DeepEqual(sizes, tc.sizes) {
+			t.Errorf("ops %d, bytes %d: batches of %v, expected %v", tc.ops, tc.bytes, sizes, tc.sizes)
+		}
+	}
+	putMaxTxnOps, putMaxTxnBytes = 10, sz-1
+	if _, err := batchChanges(changes); err == nil {
+		t.Error("change exceeding the transaction size is accepted")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	reloadFailureRerun     = "rerun"
+	reloadFailureRetry     = "retry"
+	reloadFailureUnhealthy = "unhealthy"
+	reloadFailureIgnore    = "ignore"
+)
+
+const (
+	defaultReloadRetries = 3
+	defaultReloadBackoff = time.Second
+	maxReloadBackoff     = 5 * time.Minute
+)
+
+type reloadResult int
+
+const (
+	reloadDone reloadResult = iota
+	reloadRetry
+	reloadFailed
+)
+
+// reloadScheduler coalesces bursts of changes into a single reload command run: the command is run
+// once there are no changes for the quiet period, but no later than max delay since the first change
+// of the burst, and no sooner than min interval since the previous run
+type reloadScheduler struct {
+	quietPeriod time.Duration
+	maxDelay    time.Duration
+	minInterval time.Duration
+
+	pending     bool
+	first, last time.Time
+	lastRun     time.Time
+	// set when the failed command is to be retried
+	retryAt time.Time
+	timer   *time.Timer
+}
+
+func (s *reloadScheduler) request() {
+	now := time.Now()
+	if !s.pending {
+		s.pending, s.first = true, now
+	}
+	s.last = now
+}
+
+func (s *reloadScheduler) done() {
+	s.pending, s.lastRun, s.retryAt = false, time.Now(), time.Time{}
+}
+
+// retry schedules the command to run again after the delay, even if there are no more changes
+func (s *reloadScheduler) retry(delay time.Duration) {
+	s.request()
+	s.retryAt = time.Now().Add(delay)
+}
+
+func (s *reloadScheduler) due() time.Time {
+	due := s.last.Add(s.quietPeriod)
+	if s.maxDelay > 0 {
+		if limit := s.first.Add(s.maxDelay); limit.Before(due) {
+			due = limit
+		}
+	}
+	if next := s.lastRun.Add(s.minInterval); next.After(due) {
+		due = next
+	}
+	if s.retryAt.After(due) {
+		due = s.retryAt
+	}
+	return due
+}
+
+// arm returns the channel which fires when the pending reload is due, or nil if there's none
+func (s *reloadScheduler) arm() <-chan time.Time {
+	if s.timer == nil {
+		s.timer = time.NewTimer(0)
+	}
+	if !s.timer.Stop() {
+		select {
+		case <-s.timer.C:
+		default:
+		}
+	}
+	if !s.pending {
+		return nil
+	}
+	d := time.Until(s.due())
+	if d < 0 {
+		d = 0
+	}
+	s.timer.Reset(d)
+	return s.timer.C
+}
+
+func validateReloadFailure(value string) error {
+	switch value {
+	case reloadFailureRerun, reloadFailureRetry, reloadFailureUnhealthy, reloadFailureIgnore:
+		return nil
+	}
+	return errors.New("invalid reload-failure value " + value)
+}
+
+// runReload runs the command, and if it fails, decides according to the failure policy whether
+// the changes are kept, rolled back, or the command is to be retried with the changes in place
+func (w *watcher) runReload(rev int64) reloadResult {
+	if w.stopping() {
+		// the command is left pending, so it's run after restart
+		w.log().info("watcher is stopping, not running the command", "command", w.cmd, "revision", rev)
+		return reloadRetry
+	} else if w.runCmd(rev) {
+		w.attempt = 0
+		atomic.StoreInt32(&w.unhealthy, 0)
+		return reloadDone
+	}
+	defer w.reportStatus()
+	switch w.reloadFailure {
+	case reloadFailureIgnore:
+		w.attempt = 0
+		return reloadDone
+	case reloadFailureRetry:
+		if w.attempt < w.reloadRetries {
+			delay := w.reloadBackoff << uint(w.attempt)
+			if delay > maxReloadBackoff || delay < w.reloadBackoff {
+				delay = maxReloadBackoff
+			}
+			w.attempt++
+			w.log().warn("retrying command", "command", w.cmd, "revision", rev, "delay", delay, "attempt", w.attempt, "retries", w.reloadRetries)
+			w.reload.retry(delay)
+			return reloadRetry
+		}
+		w.log().error("command failed too many times, giving up until the next change", "command", w.cmd, "revision", rev, "attempts", w.attempt+1)
+	case reloadFailureUnhealthy:
+		atomic.StoreInt32(&w.unhealthy, 1)
+		w.log().error("watcher is unhealthy", "revision", rev)
+	}
+	w.attempt = 0
+	return reloadFailed
+}
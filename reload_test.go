@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoppingWatcherLeavesCommandPending(t *testing.T) {
+	root, marker := t.TempDir(), filepath.Join(t.TempDir(), "ran")
+	wc := &watcherConfig{name: "watcher /test", Prefix: "/test", Root: root, Command: []string{"sh", "-c", "touch " + marker}}
+	w, err := wc.newWatcher(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.loadState()
+	w.pending, w.changes, w.stopCtx, w.cmdCtx = newTreeUpdates(), newTreeChanges(), ctx, context.Background()
+	data := []byte("a = 1\n")
+	w.pending.set("a.conf", &treeUpdate{data: data, hasData: true, digest: string(contentDigest(nil, data))})
+
+	w.promote(7)
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatalf("command is run while the watcher is stopping: %v", err)
+	} else if !w.state.Pending || w.state.Revision != 0 {
+		t.Fatalf("command is not left pending: pending %v, revision %d", w.state.Pending, w.state.Revision)
+	} else if content, err := ioutil.ReadFile(filepath.Join(root, "a.conf")); err != nil || string(content) != "a = 1\n" {
+		t.Fatalf("a.conf is not applied: %q, %v", content, err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func signingKeyID(pub ed25519.PublicKey) string {
+	h := sha256.Sum256(pub)
+	return hex.EncodeToString(h[:keyIDSize])
+}
+
+// manifestSigner signs tree manifests with an ed25519 key
+type manifestSigner struct {
+	id  string
+	key ed25519.PrivateKey
+}
+
+// loadManifestSigner reads the seed of the signing key, it returns nil if no file is given
+func loadManifestSigner(file string) (*manifestSigner, error) {
+	if file == "" {
+		return nil, nil
+	}
+	seed, err := readKeyFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key := ed25519.NewKeyFromSeed(seed[:])
+	return &manifestSigner{id: signingKeyID(key.Public().(ed25519.PublicKey)), key: key}, nil
+}
+
+func (s *manifestSigner) sign(data []byte) (key string, signature []byte) {
+	return s.id, ed25519.Sign(s.key, data)
+}
+
+// trustedKeys are the public keys watchers accept tree manifests signed with
+type trustedKeys struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// loadTrustedKeys reads files of base64-encoded public keys, one per line, it returns nil if no
+// files are given
+func loadTrustedKeys(files []string) (*trustedKeys, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	tk := &trustedKeys{keys: make(map[string]ed25519.PublicKey)}
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, fmt.Errorf("error reading trusted keys: %s", err)
+		}
+		s := bufio.NewScanner(f)
+		for n := 1; s.Scan(); n++ {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			raw, err := base64.StdEncoding.DecodeString(line)
+			if err != nil || len(raw) != ed25519.PublicKeySize {
+				_ = f.Close()
+				return nil, fmt.Errorf("invalid trusted key in %s line %d: must contain %d base64-encoded bytes", fn, n, ed25519.PublicKeySize)
+			}
+			pub := ed25519.PublicKey(raw)
+			tk.keys[signingKeyID(pub)] = pub
+		}
+		err = s.Err()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading trusted keys: %s", err)
+		}
+	}
+	if len(tk.keys) == 0 {
+		return nil, errors.New("no trusted keys found")
+	}
+	return tk, nil
+}
+
+// verify checks that the manifest is signed with one of the trusted keys
+func (tk *trustedKeys) verify(sm *signedManifest) error {
+	if sm.Key == "" {
+		return errors.New("manifest is not signed")
+	}
+	pub, ok := tk.keys[sm.Key]
+	if !ok {
+		return fmt.Errorf("manifest is signed with untrusted key %s", sm.Key)
+	} else if !ed25519.Verify(pub, sm.Manifest, sm.Signature) {
+		return fmt.Errorf("manifest signature of key %s does not verify", sm.Key)
+	}
+	return nil
+}
+
+// verify checks resolved updates against the signed manifest: updated entries must be listed with
+// the same content digest, removed ones must not be listed
+func (m *treeManifest) verify(u *treeUpdates) error {
+	for _, rel := range u.order {
+		tu := u.entries[rel]
+		e, listed := m.Entries[rel]
+		if tu.removed {
+			if listed {
+				return fmt.Errorf("%s is removed from the store, but listed in the manifest", rel)
+			}
+			continue
+		} else if !listed {
+			return fmt.Errorf("%s is not listed in the manifest", rel)
+		} else if tu.hasData {
+			if err := checkDigest(tu.data, e.Hash, e.meta()); err != nil {
+				return fmt.Errorf("content of %s does not match the manifest: %s", rel, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSigner generates a signing key with keygen, and returns the signer and the trusted keys of it
+func testSigner(t *testing.T) (*manifestSigner, *trustedKeys) {
+	keyFile := filepath.Join(t.TempDir(), "sign.key")
+	if err := runConfsync("keygen", "--sign", keyFile); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadManifestSigner(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk, err := loadTrustedKeys([]string{keyFile + ".pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, tk
+}
+
+func TestManifestSignature(t *testing.T) {
+	s, tk := testSigner(t)
+	other, _ := testSigner(t)
+	m := newTreeManifest("/test")
+	m.add("a.conf", []byte("digest"), 6, &fileMeta{Mode: "0644"})
+
+	signed, err := m.encode(s)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = decodeManifest("/test", signed, tk); err != nil {
+		t.Fatalf("signed manifest does not verify: %s", err)
+	}
+	for name, value := range map[string]func() ([]byte, error){
+		"unsigned":            func() ([]byte, error) { return m.encode(nil) },
+		"signed by other key": func() ([]byte, error) { return m.encode(other) },
+		"tampered": func() ([]byte, error) {
+			return []byte(strings.Replace(string(signed), `"size":6`, `"size":7`, 1)), nil
+		},
+	} {
+		v, err := value()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(v) == string(signed) {
+			t.Fatalf("%s manifest is the same as the signed one", name)
+		} else if _, err = decodeManifest("/test", v, tk); err == nil {
+			t.Errorf("%s manifest verifies", name)
+		}
+	}
+	// manifests are not verified without trusted keys
+	if unsigned, err := m.encode(nil); err != nil {
+		t.Fatal(err)
+	} else if _, err = decodeManifest("/test", unsigned, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadTrustedKeys(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"empty":   "# no keys\n\n",
+		"invalid": "not a key\n",
+		"short":   "AAAA\n",
+	} {
+		fn := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		} else if _, err = loadTrustedKeys([]string{fn}); err == nil {
+			t.Errorf("%s trusted keys file is accepted", name)
+		}
+	}
+	if tk, err := loadTrustedKeys(nil); tk != nil || err != nil {
+		t.Errorf("no trusted keys files: %v, %v", tk, err)
+	}
+}
+
+func TestManifestVerifyUpdates(t *testing.T) {
+	content := []byte("a = 1\n")
+	m := newTreeManifest("/test")
+	m.add("a.conf", contentDigest(nil, content), len(content), &fileMeta{Mode: "0644"})
+	m.add("b.conf", contentDigest(nil, content), len(content), &fileMeta{Mode: "0644"})
+	for name, tc := range map[string]struct {
+		rel string
+		tu  *treeUpdate
+		ok  bool
+	}{
+		"listed":          {"a.conf", &treeUpdate{data: content, hasData: true}, true},
+		"not listed":      {"c.conf", &treeUpdate{data: content, hasData: true}, false},
+		"modified":        {"a.conf", &treeUpdate{data: []byte("a = 2\n"), hasData: true}, false},
+		"removed":         {"c.conf", &treeUpdate{removed: true}, true},
+		"removed, listed": {"b.conf", &treeUpdate{removed: true}, false},
+	} {
+		u := newTreeUpdates()
+		u.set(tc.rel, tc.tu)
+		m.resolve(u)
+		if err := m.verify(u); (err == nil) != tc.ok {
+			t.Errorf("%s: verify returned %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const defaultStateDir = "/var/lib/confsync"
+
+// watchState is the local manifest of a watcher, kept between agent restarts
+type watchState struct {
+	Prefix string `json:"prefix"`
+	Root   string `json:"root"`
+	// the last store revision applied, and whether the reload command is yet to be run for it
+	Revision    int64 `json:"revision"`
+	Pending     bool  `json:"pending,omitempty"`
+	Generations bool  `json:"generations,omitempty"`
+	// entries written by the watcher, mapped to their content digests
+	Entries map[string]string `json:"entries"`
+	// directories stored as explicit tree entries, they are kept when emptied
+	Dirs map[string]bool `json:"dirs,omitempty"`
+}
+
+func stateFilePath(dir, prefix, root string) string {
+	h := sha256.Sum256([]byte(prefix + "\x00" + root))
+	return filepath.Join(dir, hex.EncodeToString(h[:8])+".json")
+}
+
+func loadState(path, prefix, root string) (*watchState, error) {
+	st := &watchState{Prefix: prefix, Root: root, Entries: make(map[string]string), Dirs: make(map[string]bool)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return st, err
+	} else if err = json.Unmarshal(data, st); err != nil {
+		return st, fmt.Errorf("error reading state file %s: %s", path, err)
+	}
+	if st.Entries == nil {
+		st.Entries = make(map[string]string)
+	}
+	if st.Dirs == nil {
+		st.Dirs = make(map[string]bool)
+	}
+	return st, nil
+}
+
+func (st *watchState) save(path string) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating state directory: %s", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".temp*")
+	if err != nil {
+		return fmt.Errorf("error saving state file %s: %s", path, err)
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = syscall.Unlink(f.Name())
+		return fmt.Errorf("error saving state file %s: %s", path, err)
+	}
+	return nil
+}
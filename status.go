@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+const (
+	defaultStatusTTL     = 30 * time.Second
+	statusRequestTimeout = 5 * time.Second
+)
+
+const (
+	commandOK          = "ok"
+	commandFailed      = "failed"
+	commandCheckFailed = "check failed"
+	// the tree does not match its signed manifest
+	commandRefused = "refused"
+)
+
+// agentStatus is reported by watch command for each watcher in the status key of the watcher prefix
+type agentStatus struct {
+	Host string `json:"host"`
+	Root string `json:"root"`
+	// the last applied store revision and the digest of the applied tree
+	Revision int64  `json:"revision"`
+	Hash     string `json:"hash"`
+	// set if there are changes received, but not applied yet
+	Pending bool `json:"pending,omitempty"`
+	// the last command result, exit status is -1 if it was not started or terminated by a signal
+	Command    string `json:"command,omitempty"`
+	ExitStatus int    `json:"exit_status"`
+	Error      string `json:"error,omitempty"`
+	Unhealthy  bool   `json:"unhealthy,omitempty"`
+	// set while the failed command is retried
+	Retrying bool `json:"retrying,omitempty"`
+	// files not written, as their content does not match the stored digest
+	Quarantined []string `json:"quarantined,omitempty"`
+	// the latest tree format the agent supports, 0 for format 1 agents
+	Format int       `json:"format,omitempty"`
+	Time   time.Time `json:"time"`
+
+	// status key revision
+	modRevision int64
+}
+
+func (st *agentStatus) failed() bool {
+	return st.Unhealthy || st.Command == commandFailed || st.Command == commandCheckFailed || st.Command == commandRefused
+}
+
+// treeStatus is the tree stored under the prefix, and the agents reporting their status for it
+type treeStatus struct {
+	// the last revision the tree has changed at, and the tree digest
+	revision int64
+	hash     string
+	agents   map[string]*agentStatus
+	// store revision the tree status has been read at
+	header int64
+}
+
+func readTreeStatus(c *clientv3.Client, prefix string) (*treeStatus, error) {
+	resp, err := c.Get(c.Ctx(), prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ts           = &treeStatus{agents: make(map[string]*agentStatus), header: resp.Header.Revision}
+		entries      = make(map[string]string)
+		manifest     *treeManifest
+		statusPrefix = internalKey(prefix, statusDirName) + "/"
+	)
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if strings.HasPrefix(key, statusPrefix) {
+			if st, err := decodeAgentStatus(kv); err != nil {
+				log.warn("invalid agent status", "key", key, "error", err)
+			} else {
+				ts.agents[key] = st
+			}
+			continue
+		} else if key == internalKey(prefix, manifestKey) {
+			if manifest, err = decodeManifest(prefix, kv.Value, nil); err != nil {
+				log.warn("invalid tree manifest", "key", key, "error", err)
+			}
+			continue
+		} else if key == internalKey(prefix, generationKey) {
+			if kv.ModRevision > ts.revision {
+				ts.revision = kv.ModRevision
+			}
+			continue
+		}
+		rel, attr, ok := treeKeyPath(prefix, key)
+		if !ok {
+			continue
+		} else if kv.ModRevision > ts.revision {
+			ts.revision = kv.ModRevision
+		}
+		if attr == hashKeyName {
+			entries[rel] = string(kv.Value)
+		}
+	}
+	if manifest != nil {
+		// format 2 trees may have no .hash keys
+		entries = make(map[string]string, len(manifest.Entries))
+		for rel, e := range manifest.Entries {
+			entries[rel] = e.Hash
+		}
+	}
+	ts.hash = treeDigest(entries)
+	return ts, nil
+}
+
+func decodeAgentStatus(kv *mvccpb.KeyValue) (*agentStatus, error) {
+	st := &agentStatus{modRevision: kv.ModRevision}
+	if err := json.Unmarshal(kv.Value, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// waitForAgents waits until all the agents reporting their status for the prefix apply the current tree,
+// or report a failure, and reports the ones which have not
+func waitForAgents(cmd *cobra.Command, c *clientv3.Client, prefix string, timeout time.Duration) error {
+	ts, err := readTreeStatus(c, prefix)
+	if err != nil {
+		return err
+	} else if len(ts.agents) == 0 {
+		log.warn("no agents report their status", "prefix", prefix)
+		return nil
+	}
+	log.info("waiting for agents to apply the tree", "prefix", prefix, "revision", ts.revision, "agents", len(ts.agents))
+	var (
+		results = make(map[string]string)
+		check   = func(key string, st *agentStatus) {
+			if st.Revision >= ts.revision && len(st.Quarantined) > 0 {
+				results[key] = "failed"
+				log.error("agent quarantined corrupt files of the tree", "prefix", prefix, "agent", st.Host, "root", st.Root, "revision", st.Revision, "files", strings.Join(st.Quarantined, ","))
+			} else if st.Revision >= ts.revision {
+				results[key] = "applied"
+				log.info("agent applied the tree", "prefix", prefix, "agent", st.Host, "root", st.Root, "revision", st.Revision)
+			} else if st.modRevision > ts.revision && st.failed() && !st.Retrying {
+				results[key] = "failed"
+				log.error("agent failed to apply the tree", "prefix", prefix, "agent", st.Host, "root", st.Root, "revision", st.Revision, "error", st.Error)
+			}
+		}
+	)
+	for key, st := range ts.agents {
+		check(key, st)
+	}
+	ctx, cancel := context.WithTimeout(c.Ctx(), timeout)
+	defer cancel()
+	statusPrefix := internalKey(prefix, statusDirName) + "/"
+	ch := c.Watch(ctx, statusPrefix, clientv3.WithPrefix(), clientv3.WithRev(ts.header+1))
+	for len(results) < len(ts.agents) {
+		resp, ok := <-ch
+		if !ok || ctx.Err() != nil {
+			break
+		} else if err := resp.Err(); err != nil {
+			return err
+		}
+		for _, ev := range resp.Events {
+			key := string(ev.Kv.Key)
+			if _, ok := ts.agents[key]; !ok || results[key] != "" {
+				// agents started after the tree was updated are not waited for
+				continue
+			} else if ev.Type == clientv3.EventTypeDelete {
+				results[key] = "gone"
+				log.error("agent is gone", "prefix", prefix, "agent", ts.agents[key].Host, "root", ts.agents[key].Root)
+			} else if st, err := decodeAgentStatus(ev.Kv); err != nil {
+				log.warn("invalid agent status", "key", key, "error", err)
+			} else {
+				ts.agents[key] = st
+				check(key, st)
+			}
+		}
+	}
+	problems := 0
+	for key, st := range ts.agents {
+		if results[key] == "" {
+			log.error("agent has not applied the tree in time", "prefix", prefix, "agent", st.Host, "root", st.Root, "revision", st.Revision)
+		}
+		if results[key] != "applied" {
+			problems++
+		}
+	}
+	if problems > 0 {
+		log.error("agents have not applied the tree", "prefix", prefix, "revision", ts.revision, "agents", len(ts.agents), "problems", problems)
+		cmd.SilenceErrors, cmd.SilenceUsage = true, true
+		return exitStatus(1)
+	}
+	log.info("all agents applied the tree", "prefix", prefix, "revision", ts.revision, "agents", len(ts.agents))
+	return nil
+}
+
+// treeDigest identifies the tree by its entries and their content digests
+func treeDigest(entries map[string]string) string {
+	paths := make([]string, 0, len(entries))
+	for rel := range entries {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, rel := range paths {
+		fmt.Fprintf(h, "%s\x00%s\n", rel, entries[rel])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// exitStatusOf returns the command exit status, or -1 if it was not started or terminated by a signal
+func exitStatusOf(err error) int {
+	if err == nil {
+		return 0
+	} else if ee, ok := err.(*exec.ExitError); ok {
+		return ee.ExitCode()
+	}
+	return -1
+}
+
+// statusReporter keeps the status keys of watchers bound to the agent lease, so they are removed
+// when the agent is gone
+type statusReporter struct {
+	c    *clientv3.Client
+	name string
+	ttl  time.Duration
+
+	mu       sync.Mutex
+	lease    clientv3.LeaseID
+	statuses map[string]string
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func newStatusReporter(c *clientv3.Client, name string, ttl time.Duration) *statusReporter {
+	return &statusReporter{c: c, name: name, ttl: ttl, statuses: make(map[string]string)}
+}
+
+// key returns the status key of the watcher, watchers of the same prefix with different roots report
+// their status in separate keys
+func (r *statusReporter) key(w *watcher) string {
+	root, _ := filepath.Abs(w.root)
+	h := sha256.Sum256([]byte(root))
+	return internalKey(w.prefix, statusDirName, r.name+"-"+hex.EncodeToString(h[:4]))
+}
+
+func (r *statusReporter) start() {
+	var ctx context.Context
+	ctx, r.cancel = context.WithCancel(r.c.Ctx())
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		r.run(ctx)
+	}()
+}
+
+// stop revokes the lease, so all the status keys are removed on shutdown
+func (r *statusReporter) stop() {
+	r.cancel()
+	<-r.done
+	r.revoke()
+}
+
+// run grants the lease and keeps it alive until ctx is done, granting a new one and writing all
+// the status keys again if the lease is lost
+func (r *statusReporter) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		resp, err := r.c.Grant(ctx, int64(r.ttl/time.Second))
+		if err == nil {
+			var ch <-chan *clientv3.LeaseKeepAliveResponse
+			if ch, err = r.c.KeepAlive(ctx, resp.ID); err == nil {
+				r.mu.Lock()
+				r.lease = resp.ID
+				for key, value := range r.statuses {
+					r.put(key, value, resp.ID)
+				}
+				r.mu.Unlock()
+				for range ch {
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				log.warn("status lease lost, granting a new one")
+				r.mu.Lock()
+				r.lease = clientv3.NoLease
+				r.mu.Unlock()
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.error("error granting status lease", "error", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(watchRetryDelay):
+		}
+	}
+}
+
+func (r *statusReporter) put(key, value string, lease clientv3.LeaseID) {
+	ctx, cancel := context.WithTimeout(r.c.Ctx(), statusRequestTimeout)
+	defer cancel()
+	if _, err := r.c.Put(ctx, key, value, clientv3.WithLease(lease)); err != nil {
+		log.error("error updating status", "key", key, "error", err)
+		metricTxnErrors.inc("status")
+	}
+}
+
+func (r *statusReporter) report(key string, st *agentStatus) {
+	data, _ := json.Marshal(st)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses[key] = string(data)
+	if r.lease != clientv3.NoLease {
+		r.put(key, string(data), r.lease)
+	}
+}
+
+// remove deletes the status of the stopped watcher
+func (r *statusReporter) remove(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.statuses, key)
+	ctx, cancel := context.WithTimeout(r.c.Ctx(), statusRequestTimeout)
+	defer cancel()
+	if _, err := r.c.Delete(ctx, key); err != nil {
+		log.error("error removing status", "key", key, "error", err)
+	}
+}
+
+func (r *statusReporter) revoke() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lease != clientv3.NoLease {
+		ctx, cancel := context.WithTimeout(r.c.Ctx(), statusRequestTimeout)
+		defer cancel()
+		if _, err := r.c.Revoke(ctx, r.lease); err != nil {
+			log.error("error revoking status lease", "error", err)
+		}
+		r.lease = clientv3.NoLease
+	}
+}
+
+// reportStatus updates the watcher status served on /status, and its status key, if status reporting is enabled
+func (w *watcher) reportStatus() {
+	root, _ := filepath.Abs(w.root)
+	st := &agentStatus{
+		Root:       root,
+		Revision:   w.state.Revision,
+		Hash:       treeDigest(w.state.Entries),
+		Pending:    !w.pending.empty(),
+		Command:    w.lastCommand,
+		ExitStatus: w.lastExitStatus,
+		Error:      w.lastError,
+		Unhealthy:  atomic.LoadInt32(&w.unhealthy) != 0,
+		Retrying:   w.attempt > 0,
+		Format:     treeFormat,
+		Time:       time.Now().UTC(),
+	}
+	for rel := range w.quarantined {
+		st.Quarantined = append(st.Quarantined, rel)
+	}
+	sort.Strings(st.Quarantined)
+	if w.status != nil {
+		st.Host = w.status.name
+	}
+	w.reportedRevision = st.Revision
+	w.health.update(st)
+	if w.status != nil {
+		w.status.report(w.status.key(w), st)
+	}
+}
+
+// recordCommand keeps the command result for the status
+func (w *watcher) recordCommand(result string, err error) {
+	w.lastCommand, w.lastExitStatus, w.lastError = result, exitStatusOf(err), ""
+	if err != nil {
+		w.lastError = err.Error()
+	}
+}
+
+var statusProblemsOnly bool
+
+func newStatusCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status [flags] <prefix>",
+		Short: "Shows which agents have applied the tree stored under the prefix",
+		Long: `status command lists watch agents reporting their status for the prefix key namespace, with the
+store revision and the tree each one has applied, and the result of the last command run.
+
+Agents which have not applied the current tree yet are reported as stale, and the ones whose last command
+(or the check command) failed, as failing, and the ones which quarantined files not matching their stored
+digests (see watch command), as quarantined. status command exits with non-zero status if there are any.
+Agents keep their status keys while they run (see watch --status-ttl), so stopped agents are not listed.
+
+Example:
+
+confsync status /etc/firewall/keepalived
+
+`,
+		RunE: statusCommandFunc,
+		Args: cobra.ExactArgs(1),
+	}
+	cmd.Flags().BoolVar(&statusProblemsOnly, "problems", false, "only list stale and failing agents")
+	return cmd
+}
+
+func statusCommandFunc(cmd *cobra.Command, args []string) error {
+	c := mustClient()
+	defer c.Close()
+	prefix := args[0]
+	ts, err := readTreeStatus(c, prefix)
+	if err != nil {
+		return err
+	}
+	revision, hash := ts.revision, ts.hash
+	agents := make([]*agentStatus, 0, len(ts.agents))
+	for _, st := range ts.agents {
+		agents = append(agents, st)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		if agents[i].Host != agents[j].Host {
+			return agents[i].Host < agents[j].Host
+		}
+		return agents[i].Root < agents[j].Root
+	})
+	fmt.Printf("prefix %s revision %d tree %.12s, %d agent(s)\n\n", prefix, revision, hash, len(agents))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tROOT\tREVISION\tTREE\tCOMMAND\tREPORTED\tSTATE")
+	problems := 0
+	for _, st := range agents {
+		state := "ok"
+		if st.failed() {
+			state = "failing"
+		} else if len(st.Quarantined) > 0 {
+			state = "quarantined"
+		} else if st.Revision < revision || st.Hash != hash {
+			state = "stale"
+		}
+		if state != "ok" {
+			problems++
+		} else if statusProblemsOnly {
+			continue
+		}
+		command := st.Command
+		if command == "" {
+			command = "-"
+		} else if st.ExitStatus > 0 {
+			command = fmt.Sprintf("%s (%d)", command, st.ExitStatus)
+		}
+		reported := time.Since(st.Time).Round(time.Second).String() + " ago"
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.12s\t%s\t%s\t%s\n", st.Host, st.Root, st.Revision, st.Hash, command, reported, state)
+	}
+	_ = tw.Flush()
+	if problems > 0 {
+		cmd.SilenceErrors, cmd.SilenceUsage = true, true
+		return exitStatus(1)
+	}
+	return nil
+}
@@ -0,0 +1,759 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+// treeUpdate collects the changed keys of a single tree entry
+type treeUpdate struct {
+	data    []byte
+	digest  string
+	meta    *fileMeta
+	hasData bool
+	removed bool
+}
+
+// attrKey is a key named as an entry attribute, which may be an entry of its own in format 2 trees,
+// it's only applied once the updates are resolved against the tree manifest
+type attrKey struct {
+	kv      *mvccpb.KeyValue
+	deleted bool
+}
+
+type treeUpdates struct {
+	entries  map[string]*treeUpdate
+	order    []string
+	attrKeys []attrKey
+}
+
+func newTreeUpdates() *treeUpdates {
+	return &treeUpdates{entries: make(map[string]*treeUpdate)}
+}
+
+func (u *treeUpdates) empty() bool {
+	return len(u.order) == 0 && len(u.attrKeys) == 0
+}
+
+func (u *treeUpdates) set(rel string, tu *treeUpdate) {
+	if _, ok := u.entries[rel]; !ok {
+		u.order = append(u.order, rel)
+	}
+	u.entries[rel] = tu
+}
+
+func (u *treeUpdates) remove(rel string) {
+	u.set(rel, &treeUpdate{removed: true})
+}
+
+// merge adds later updates to the set, replacing the earlier ones
+func (u *treeUpdates) merge(later *treeUpdates) {
+	for _, rel := range later.order {
+		tu := later.entries[rel]
+		if prev, ok := u.entries[rel]; ok && !tu.removed && !tu.hasData {
+			if tu.meta != nil {
+				prev.meta = tu.meta
+			}
+			if tu.digest != "" {
+				prev.digest = tu.digest
+			}
+		} else {
+			u.set(rel, tu)
+		}
+	}
+	u.attrKeys = append(u.attrKeys, later.attrKeys...)
+}
+
+// drop removes the entry updates from the set
+func (u *treeUpdates) drop(rel string) {
+	if _, ok := u.entries[rel]; !ok {
+		return
+	}
+	delete(u.entries, rel)
+	for i, r := range u.order {
+		if r == rel {
+			u.order = append(u.order[:i], u.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// checkDigest checks the content against its stored digest, salted if the content is stored encrypted
+func checkDigest(data []byte, digest string, meta *fileMeta) error {
+	var salt []byte
+	if digest == "" {
+		return errors.New("content digest is missing")
+	} else if meta != nil && meta.Salt != "" {
+		var err error
+		if salt, err = hex.DecodeString(meta.Salt); err != nil {
+			return fmt.Errorf("invalid digest salt: %s", err)
+		}
+	}
+	if sum := contentDigest(salt, data); string(sum) != digest {
+		return fmt.Errorf("content digest %.12s does not match the stored digest %.12s", sum, digest)
+	}
+	return nil
+}
+
+// quarantine drops pending file updates, content of which does not match the stored digest, so the
+// previous files are kept until the file is updated again
+func (w *watcher) quarantine() {
+	for _, rel := range append([]string(nil), w.pending.order...) {
+		tu := w.pending.entries[rel]
+		if tu.removed || !tu.hasData {
+			continue
+		}
+		if err := checkDigest(tu.data, tu.digest, tu.meta); err != nil {
+			w.log().error("file content is corrupt, quarantined", "path", rel, "error", err)
+			w.pending.drop(rel)
+			w.quarantined[rel] = err.Error()
+			metricFilesQuarantined.inc(w.prefix, w.root)
+		}
+	}
+}
+
+func (u *treeUpdates) add(prefix string, kv *mvccpb.KeyValue, deleted bool, kr *keyring) {
+	if _, ok := entryRelPath(prefix, string(kv.Key)); !ok {
+		// internal keys, such as agent status keys, are not tree entries
+		return
+	} else if isAttrName(path.Base(string(kv.Key))) {
+		u.attrKeys = append(u.attrKeys, attrKey{kv: kv, deleted: deleted})
+	} else if rel, ok := keyRelPath(prefix, string(kv.Key)); ok {
+		u.addKey(prefix, rel, "", kv, deleted, kr)
+	}
+}
+
+// addKey applies the key of the entry, holding its content or the attribute
+func (u *treeUpdates) addKey(prefix, rel, attr string, kv *mvccpb.KeyValue, deleted bool, kr *keyring) {
+	tu := u.entries[rel]
+	if tu == nil {
+		tu = &treeUpdate{}
+		u.set(rel, tu)
+	}
+	switch attr {
+	case "":
+		if deleted {
+			tu.removed = true
+		} else if data, err := decodeContent(rel, kv.Value, kr, maxContentSize); err != nil {
+			log.error("error decoding file content, skipping", "prefix", prefix, "key", string(kv.Key), "revision", kv.ModRevision, "error", err)
+		} else {
+			tu.data, tu.hasData, tu.removed = data, true, false
+		}
+	case hashKeyName:
+		if !deleted {
+			tu.digest = string(kv.Value)
+		}
+	case metaKeyName:
+		if deleted {
+			return
+		} else if meta, err := decodeFileMeta(kv.Value); err != nil {
+			log.warn("error decoding file metadata, ignoring", "prefix", prefix, "key", string(kv.Key), "revision", kv.ModRevision, "error", err)
+		} else {
+			tu.meta = meta
+		}
+	}
+}
+
+// applyUpdates applies the updates to the tree in base directory (the watcher root or its copy),
+// saving the previous state of updated entries in the backup, if any
+func (w *watcher) applyUpdates(base string, u *treeUpdates, backup *treeBackup) *treeChanges {
+	changes := newTreeChanges()
+	// removals go first, deepest entries first, so a directory is emptied before it's removed and
+	// an entry which changed its type is replaced; then updates go parents first
+	sort.Strings(u.order)
+	for i := len(u.order) - 1; i >= 0; i-- {
+		if rel := u.order[i]; u.entries[rel].removed {
+			if w.removeEntry(base, rel, backup) {
+				changes.remove(rel)
+			}
+		}
+	}
+	for _, rel := range u.order {
+		tu := u.entries[rel]
+		fn := filepath.Join(base, rel)
+		if tu.removed {
+			continue
+		}
+		backup.save(base, rel)
+		if tu.hasData {
+			var (
+				updated bool
+				err     error
+			)
+			if tu.meta.isDir() {
+				updated, err = w.maybeUpdateDir(fn, tu.meta)
+			} else if tu.meta.isSymlink() {
+				updated, err = w.maybeUpdateSymlink(base, fn, tu.meta)
+			} else {
+				updated, err = w.maybeUpdateFile(fn, tu.data, tu.meta)
+			}
+			if err != nil {
+				w.log().error("failed to synchronize file", "path", fn, "error", err)
+			} else if updated {
+				changes.update(rel)
+			}
+		} else if tu.meta != nil {
+			if updated, err := w.maybeUpdateAttrs(fn, tu.meta); err != nil {
+				w.log().error("failed to update file attributes", "path", fn, "error", err)
+			} else if updated {
+				changes.update(rel)
+			}
+		}
+	}
+	return changes
+}
+
+// treeChanges lists the entries updated and removed by applying updates
+type treeChanges struct {
+	updated map[string]bool
+	removed map[string]bool
+}
+
+func newTreeChanges() *treeChanges {
+	return &treeChanges{updated: make(map[string]bool), removed: make(map[string]bool)}
+}
+
+func (c *treeChanges) update(rel string) {
+	c.updated[rel] = true
+	delete(c.removed, rel)
+}
+
+func (c *treeChanges) remove(rel string) {
+	c.removed[rel] = true
+	delete(c.updated, rel)
+}
+
+// merge adds later changes
+func (c *treeChanges) merge(later *treeChanges) {
+	for rel := range later.removed {
+		c.remove(rel)
+	}
+	for rel := range later.updated {
+		c.update(rel)
+	}
+}
+
+func (c *treeChanges) count() int {
+	return len(c.updated) + len(c.removed)
+}
+
+func sortedPaths(set map[string]bool) []string {
+	paths := make([]string, 0, len(set))
+	for rel := range set {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// trackUpdates records entries written to the watcher root in the watcher state
+func (w *watcher) trackUpdates(u *treeUpdates) {
+	for _, rel := range u.order {
+		if tu := u.entries[rel]; tu.removed || tu.hasData {
+			delete(w.quarantined, rel)
+		}
+		if tu := u.entries[rel]; tu.removed {
+			delete(w.state.Entries, rel)
+			delete(w.state.Dirs, rel)
+		} else if tu.hasData {
+			w.state.Entries[rel] = tu.digest
+			if tu.meta.isDir() {
+				w.state.Dirs[rel] = true
+			} else {
+				delete(w.state.Dirs, rel)
+			}
+		}
+	}
+}
+
+func (w *watcher) removeEntry(base, rel string, backup *treeBackup) bool {
+	fn := filepath.Join(base, rel)
+	fi, err := os.Lstat(fn)
+	if os.IsNotExist(err) {
+		return false
+	}
+	backup.save(base, rel)
+	if err == nil && fi.IsDir() {
+		if removed, err := maybeRemoveDir(fn); err != nil {
+			w.log().error("error removing directory", "path", fn, "error", err)
+			return false
+		} else if !removed {
+			w.log().warn("directory is not empty, leaving it in place", "path", fn)
+			return false
+		}
+		w.log().info("removed directory", "path", fn)
+	} else if err = syscall.Unlink(fn); err != nil {
+		w.log().error("error removing file", "path", fn, "error", err)
+		return false
+	} else {
+		w.log().info("removed file", "path", fn)
+	}
+	// parent directories, which are not stored explicitly, are only kept while there are files in them
+	for d := filepath.Dir(rel); d != "." && d != "/" && !w.state.Dirs[d]; d = filepath.Dir(d) {
+		backup.save(base, d)
+		if removed, err := maybeRemoveDir(filepath.Join(base, d)); err != nil {
+			w.log().error("error removing directory", "path", filepath.Join(base, d), "error", err)
+		} else if removed {
+			w.log().info("removed directory", "path", filepath.Join(base, d))
+		} else {
+			break
+		}
+	}
+	return true
+}
+
+// dirMode adds search permission wherever read permission is set in the file mode
+func dirMode(mode int) int {
+	if mode == -1 {
+		return 0755
+	}
+	for i := 0; i < 3; i++ {
+		if (mode & 4 << uint(i*3)) != 0 {
+			mode |= 1 << uint(i*3)
+		}
+	}
+	return mode
+}
+
+func mkdirAll(path string, owner, group, mode int) error {
+	mode = dirMode(mode)
+	dir, err := os.Stat(path)
+	if err == nil {
+		if dir.IsDir() {
+			return nil
+		}
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	elts := make([]string, 1, 8)
+	elts[0] = path
+	d := path
+	for {
+		d = filepath.Dir(d)
+		if d == "." || d == "/" {
+			break
+		}
+		dir, err = os.Stat(d)
+		if err == nil {
+			if dir.IsDir() {
+				break
+			} else {
+				return fmt.Errorf("%s is not a directory", d)
+			}
+		}
+		elts = append(elts, d)
+	}
+	for i := len(elts) - 1; i >= 0; i-- {
+		err = os.Mkdir(elts[i], os.FileMode(mode))
+		if err != nil {
+			return fmt.Errorf("error creating directory %s: %s", elts[i], err)
+		}
+		if owner >= 0 {
+			if err = os.Chown(elts[i], owner, group); err != nil {
+				return fmt.Errorf("error chown %s: %s", elts[i], err)
+			}
+		}
+	}
+	return nil
+}
+
+func (w *watcher) maybeUpdateAttrs(path string, meta *fileMeta) (bool, error) {
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		// file is not synchronized yet
+		return false, nil
+	}
+	mode, uid, gid := w.fileAttrs(path, meta)
+	return updateAttrs(path, fi, mode, uid, gid)
+}
+
+func updateAttrs(path string, fi os.FileInfo, mode os.FileMode, uid, gid int) (bool, error) {
+	updated := false
+	if fi.Mode().Perm() != mode {
+		if err := os.Chmod(path, mode); err != nil {
+			return false, fmt.Errorf("error setting permissions on file %s: %s", path, err)
+		}
+		updated = true
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && ((uid >= 0 && int(st.Uid) != uid) || (gid >= 0 && int(st.Gid) != gid)) {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return false, fmt.Errorf("error setting ownership on file %s: %s", path, err)
+		}
+		updated = true
+	}
+	return updated, nil
+}
+
+func (w *watcher) maybeUpdateFile(path string, content []byte, meta *fileMeta) (bool, error) {
+	var p = filepath.Dir(path)
+	mode, uid, gid := w.fileAttrs(path, meta)
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.IsDir() {
+			return false, fmt.Errorf("error updating file: %s is a direcotry", path)
+		} else if !fi.Mode().IsRegular() {
+			// a symlink is replaced with the file
+		} else if fileContent, err := ioutil.ReadFile(path); err == nil {
+			if bytes.Compare(fileContent, content) == 0 {
+				return updateAttrs(path, fi, mode, uid, gid)
+			}
+		}
+	} else {
+		if fi, err := os.Stat(p); err == nil {
+			if !fi.IsDir() {
+				return false, fmt.Errorf("error updating %s: %s is not a directory", path, p)
+			}
+		} else if err = mkdirAll(p, w.rootOwner, w.rootGroup, w.rootMask); err != nil {
+			return false, fmt.Errorf("error updating %s: can't create directory %s: %s", path, p, err)
+		}
+	}
+	if f, err := ioutil.TempFile(p, ".temp*"); err != nil {
+		return false, fmt.Errorf("error updating %s: %s", path, err)
+	} else if _, err = f.Write(content); err != nil {
+		_ = syscall.Unlink(f.Name())
+		return false, fmt.Errorf("error updating %s: %s", path, err)
+	} else if err = f.Close(); err != nil {
+		_ = syscall.Unlink(f.Name())
+		return false, fmt.Errorf("error updating %s: %s", path, err)
+	} else {
+		if err = os.Chmod(f.Name(), mode); err != nil {
+			_ = syscall.Unlink(f.Name())
+			return false, fmt.Errorf("error setting permissions on file %s: %s", path, err)
+		}
+		if uid >= 0 || gid >= 0 {
+			if err = os.Chown(f.Name(), uid, gid); err != nil {
+				_ = syscall.Unlink(f.Name())
+				return false, fmt.Errorf("error setting ownership on file %s: %s", path, err)
+			}
+		}
+		if err = os.Rename(f.Name(), path); err != nil {
+			_ = syscall.Unlink(f.Name())
+			return false, fmt.Errorf("error updating %s: %s", path, err)
+		}
+	}
+	return true, nil
+}
+
+func (w *watcher) maybeUpdateDir(path string, meta *fileMeta) (bool, error) {
+	mode, uid, gid := w.dirAttrs(path, meta)
+	fi, err := os.Lstat(path)
+	if err == nil {
+		if fi.IsDir() {
+			return updateAttrs(path, fi, mode, uid, gid)
+		} else if err = syscall.Unlink(path); err != nil {
+			return false, fmt.Errorf("error replacing %s with a directory: %s", path, err)
+		}
+	}
+	if p := filepath.Dir(path); p != "." {
+		if err = mkdirAll(p, w.rootOwner, w.rootGroup, w.rootMask); err != nil {
+			return false, fmt.Errorf("error creating directory %s: %s", p, err)
+		}
+	}
+	if err = os.Mkdir(path, mode); err != nil {
+		return false, fmt.Errorf("error creating directory %s: %s", path, err)
+	}
+	if fi, err = os.Lstat(path); err != nil {
+		return false, err
+	} else if _, err = updateAttrs(path, fi, mode, uid, gid); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// checkLinkTarget makes sure the symlink does not point outside of the base directory, following
+// the symlinks already in the tree, which the target or the parents of the symlink may go through
+func checkLinkTarget(base, path, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("refusing symlink %s to absolute path %s", path, target)
+	}
+	root, err := resolvePath(base)
+	if err != nil {
+		return fmt.Errorf("error resolving symlink %s target: %s", path, err)
+	}
+	dest, err := resolvePath(filepath.Dir(path) + "/" + target)
+	if err != nil {
+		return fmt.Errorf("error resolving symlink %s target: %s", path, err)
+	}
+	rel, err := filepath.Rel(root, dest)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("refusing symlink %s to %s outside of %s", path, target, base)
+	}
+	return nil
+}
+
+// resolvePath evaluates the symlinks of the longest existing leading part of the path, the rest of
+// it is cleaned lexically; the path is not cleaned before, as .. after a symlink leaves its target
+func resolvePath(p string) (string, error) {
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		i := strings.LastIndex(p, "/")
+		if i <= 0 {
+			return filepath.Join(p, rest), nil
+		}
+		p, rest = p[:i], filepath.Join(p[i+1:], rest)
+	}
+}
+
+func (w *watcher) maybeUpdateSymlink(base, path string, meta *fileMeta) (bool, error) {
+	var p = filepath.Dir(path)
+	if err := checkLinkTarget(base, path, meta.Target); err != nil {
+		return false, err
+	}
+	_, uid, gid := w.fileAttrs(path, meta)
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.IsDir() {
+			return false, fmt.Errorf("error updating symlink: %s is a directory", path)
+		} else if fi.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Readlink(path); err == nil && target == meta.Target {
+				return false, nil
+			}
+		}
+	} else if err = mkdirAll(p, w.rootOwner, w.rootGroup, w.rootMask); err != nil {
+		return false, fmt.Errorf("error updating %s: can't create directory %s: %s", path, p, err)
+	}
+	tmp := filepath.Join(p, ".temp"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	if err := os.Symlink(meta.Target, tmp); err != nil {
+		return false, fmt.Errorf("error updating %s: %s", path, err)
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := os.Lchown(tmp, uid, gid); err != nil {
+			_ = syscall.Unlink(tmp)
+			return false, fmt.Errorf("error setting ownership on symlink %s: %s", path, err)
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = syscall.Unlink(tmp)
+		return false, fmt.Errorf("error updating %s: %s", path, err)
+	}
+	return true, nil
+}
+
+func maybeRemoveDir(path string) (bool, error) {
+	df, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return false, fmt.Errorf("error reading dir %s: %s", path, err)
+	}
+	defer df.Close()
+	if dn, err := df.Readdirnames(1); err != nil && err != io.EOF {
+		return false, fmt.Errorf("error reading dir %s: %s", path, err)
+	} else if len(dn) != 0 {
+		return false, nil
+	} else if err = syscall.Rmdir(path); err != nil {
+		return false, fmt.Errorf("error removing dir %s: %s", path, err)
+	} else {
+		return true, nil
+	}
+}
+
+// savedEntry is the state of a tree entry before it was updated, info is nil if the entry did not exist
+type savedEntry struct {
+	info   os.FileInfo
+	data   []byte
+	target string
+}
+
+// treeBackup keeps the previous state of the entries updated in the tree, so the update can be rolled back
+type treeBackup struct {
+	entries map[string]*savedEntry
+}
+
+func newTreeBackup() *treeBackup {
+	return &treeBackup{entries: make(map[string]*savedEntry)}
+}
+
+func (b *treeBackup) save(base, rel string) {
+	if b == nil {
+		return
+	} else if _, ok := b.entries[rel]; ok {
+		return
+	}
+	p := filepath.Join(base, rel)
+	se := &savedEntry{}
+	fi, err := os.Lstat(p)
+	if err == nil {
+		if fi.Mode().IsRegular() {
+			se.data, err = ioutil.ReadFile(p)
+		} else if fi.Mode()&os.ModeSymlink != 0 {
+			se.target, err = os.Readlink(p)
+		}
+		if err != nil {
+			log.warn("error saving file, it won't be restored on rollback", "path", p, "error", err)
+			return
+		}
+		se.info = fi
+	} else {
+		// missing parent directories are created along with the entry, and removed on rollback
+		for d := filepath.Dir(rel); d != "." && d != "/"; d = filepath.Dir(d) {
+			if _, ok := b.entries[d]; ok {
+				break
+			} else if _, err := os.Lstat(filepath.Join(base, d)); err == nil {
+				break
+			}
+			b.entries[d] = &savedEntry{}
+		}
+	}
+	b.entries[rel] = se
+}
+
+// restore rolls back the updated entries to their saved state
+func (b *treeBackup) restore(base string) {
+	rels := make([]string, 0, len(b.entries))
+	for rel := range b.entries {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	for i := len(rels) - 1; i >= 0; i-- {
+		p := filepath.Join(base, rels[i])
+		if se := b.entries[rels[i]]; se.info == nil || !se.info.IsDir() {
+			if fi, err := os.Lstat(p); err == nil && (se.info == nil || fi.IsDir()) {
+				if err = os.RemoveAll(p); err != nil {
+					log.error("error restoring file", "path", p, "error", err)
+				}
+			}
+		}
+	}
+	for _, rel := range rels {
+		if se := b.entries[rel]; se.info != nil && !se.matches(filepath.Join(base, rel)) {
+			if err := se.restore(filepath.Join(base, rel)); err != nil {
+				log.error("error restoring file", "path", filepath.Join(base, rel), "error", err)
+			} else {
+				log.info("restored file", "path", filepath.Join(base, rel))
+			}
+		}
+	}
+}
+
+// matches checks if the entry at the path is still the same as saved
+func (se *savedEntry) matches(path string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode() != se.info.Mode() {
+		return false
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if saved, ok := se.info.Sys().(*syscall.Stat_t); ok && (st.Uid != saved.Uid || st.Gid != saved.Gid) {
+			return false
+		}
+	}
+	switch mode := fi.Mode(); {
+	case mode.IsRegular():
+		data, err := ioutil.ReadFile(path)
+		return err == nil && bytes.Equal(data, se.data)
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		return err == nil && target == se.target
+	}
+	return true
+}
+
+func (se *savedEntry) restore(path string) error {
+	mode := se.info.Mode()
+	if mode.IsDir() {
+		if fi, err := os.Lstat(path); err != nil || !fi.IsDir() {
+			_ = syscall.Unlink(path)
+			if err = os.Mkdir(path, mode.Perm()); err != nil {
+				return err
+			}
+		}
+		if err := os.Chmod(path, mode.Perm()); err != nil {
+			return err
+		}
+	} else {
+		tmp := filepath.Join(filepath.Dir(path), ".temp"+strconv.FormatInt(time.Now().UnixNano(), 36))
+		if mode&os.ModeSymlink != 0 {
+			if err := os.Symlink(se.target, tmp); err != nil {
+				return err
+			}
+		} else if err := ioutil.WriteFile(tmp, se.data, mode.Perm()); err != nil {
+			_ = syscall.Unlink(tmp)
+			return err
+		} else if err = os.Chmod(tmp, mode.Perm()); err != nil {
+			_ = syscall.Unlink(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			_ = syscall.Unlink(tmp)
+			return err
+		}
+	}
+	if st, ok := se.info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(path, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree copies the directory tree preserving file modes, symlinks and (if possible) ownership
+func copyTree(src, dst string) error {
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	var dirs []dirMode
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == src && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, _ := filepath.Rel(src, p)
+		t := filepath.Join(dst, rel)
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			// directories are writable until everything is copied
+			if rel != "." {
+				if err = os.Mkdir(t, 0700); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, dirMode{t, mode.Perm()})
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			} else if err = os.Symlink(target, t); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			} else if err = ioutil.WriteFile(t, data, mode.Perm()); err != nil {
+				return err
+			} else if err = os.Chmod(t, mode.Perm()); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			_ = os.Lchown(t, int(st.Uid), int(st.Gid))
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if cerr := os.Chmod(dirs[i].path, dirs[i].mode); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+func TestTreeUpdatesSkipInternalKeys(t *testing.T) {
+	u := newTreeUpdates()
+	for _, key := range []string{
+		"/test/.confsync/status/agent-01020304",
+		"/test/.confsync/status/.hash",
+		"/test/.confsync/manifest",
+		"/testing/a.conf",
+	} {
+		u.add("/test", &mvccpb.KeyValue{Key: []byte(key), Value: []byte("x")}, false, nil)
+	}
+	if !u.empty() {
+		t.Fatalf("updates of keys outside the tree: %v, attribute keys %d", u.order, len(u.attrKeys))
+	}
+	u.add("/test", &mvccpb.KeyValue{Key: []byte("/test/a.conf"), Value: []byte("\x00Cnx")}, false, nil)
+	if tu := u.entries["a.conf"]; tu == nil || string(tu.data) != "x" {
+		t.Fatalf("a.conf update is not added: %+v", tu)
+	}
+}
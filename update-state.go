@@ -57,6 +57,7 @@ func updateStateFunc(cmd *cobra.Command, args []string) error {
 		if basePrefix != "" {
 			key = filepath.Join(basePrefix, key)
 		}
+		log.debug("updating state", "key", key, "op", cmd, "value", value)
 		switch cmd {
 		case "set":
 			ops = append(ops, clientv3.OpPut(key, value))
@@ -72,9 +73,10 @@ func updateStateFunc(cmd *cobra.Command, args []string) error {
 		args = args[3:]
 	}
 	c := mustClient()
-	_, err := c.Txn(context.Background()).If().Then(ops...).Commit()
+	resp, err := c.Txn(context.Background()).If().Then(ops...).Commit()
 	if err != nil {
 		return err
 	}
+	log.debug("state updated", "prefix", basePrefix, "revision", resp.Header.Revision)
 	return nil
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"go.etcd.io/etcd/clientv3"
+)
+
+var (
+	verifyDecryptKeys []string
+	verifyLocalOnly   bool
+)
+
+func newVerifyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify [flags] <prefix> [<directory>]",
+		Short: "Verifies the stored files and a local tree against the stored digests",
+		Long: `verify command checks the content of every file stored under the prefix key namespace against the
+digest put command stores along with it (in the tree manifest, or in the .hash key of the file for
+format 1 trees), and with a directory given (such as a watcher root), checks the files in the
+directory against the stored digests as well.
+
+Encrypted content is checked in the store only with --decrypt-key, local files are checked either way.
+With --local-only, only the directory is checked.
+
+verify command reports corrupt keys, and missing and modified local files, and exits with non-zero
+status if there are any.
+
+Example:
+
+confsync verify /services/nginx/config /etc/nginx
+
+`,
+		RunE: verifyCommandFunc,
+		Args: cobra.RangeArgs(1, 2),
+	}
+	cmd.Flags().StringArrayVar(&verifyDecryptKeys, "decrypt-key", nil, "key `file` to decrypt stored file content with (may be repeated)")
+	cmd.Flags().BoolVar(&verifyLocalOnly, "local-only", false, "only check the directory against the stored digests")
+	return cmd
+}
+
+// storedEntry is a tree entry with its content, digest and metadata keys
+type storedEntry struct {
+	key     string
+	value   []byte
+	stored  bool
+	listed  bool
+	digest  string
+	size    int64
+	meta    *fileMeta
+	metaErr error
+}
+
+func verifyCommandFunc(cmd *cobra.Command, args []string) error {
+	prefix, root := args[0], ""
+	if len(args) > 1 {
+		root = args[1]
+	} else if verifyLocalOnly {
+		return errors.New("--local-only requires a directory")
+	}
+	kr, err := loadKeyring(verifyDecryptKeys)
+	if err != nil {
+		return err
+	}
+	c := mustClient()
+	defer c.Close()
+	resp, err := c.Get(context.Background(), prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	var (
+		entries  = make(map[string]*storedEntry)
+		manifest *treeManifest
+	)
+	entry := func(rel string) *storedEntry {
+		e := entries[rel]
+		if e == nil {
+			e = &storedEntry{}
+			entries[rel] = e
+		}
+		return e
+	}
+	for _, kv := range resp.Kvs {
+		if string(kv.Key) == internalKey(prefix, manifestKey) {
+			if manifest, err = decodeManifest(prefix, kv.Value, nil); err != nil {
+				return err
+			}
+		}
+	}
+	for _, kv := range resp.Kvs {
+		rel, attr, ok := manifest.keyPath(prefix, string(kv.Key))
+		if !ok {
+			continue
+		}
+		e := entry(rel)
+		switch attr {
+		case "":
+			e.key, e.value, e.stored = string(kv.Key), kv.Value, true
+		case hashKeyName:
+			e.digest = string(kv.Value)
+		case metaKeyName:
+			e.meta, e.metaErr = decodeFileMeta(kv.Value)
+		}
+	}
+	if manifest != nil {
+		for rel, me := range manifest.Entries {
+			e := entry(rel)
+			e.listed, e.digest, e.size, e.meta, e.metaErr = true, me.Hash, me.Size, me.meta(), nil
+		}
+	}
+	rels := make([]string, 0, len(entries))
+	for rel := range entries {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	problems, skipped := 0, 0
+	report := func(kind, name string, err error) {
+		problems++
+		fmt.Printf("%s %s: %s\n", kind, name, err)
+	}
+	for _, rel := range rels {
+		e := entries[rel]
+		if !e.stored {
+			report("corrupt", filepath.Join(prefix, rel), errors.New("content key is missing"))
+			continue
+		} else if manifest != nil && !e.listed {
+			report("corrupt", e.key, errors.New("not listed in the tree manifest"))
+			continue
+		} else if e.metaErr != nil {
+			report("corrupt", e.key, fmt.Errorf("invalid metadata: %s", e.metaErr))
+			continue
+		}
+		if !verifyLocalOnly {
+			limit := int64(maxContentSize)
+			if e.listed && e.size != unknownSize {
+				limit = e.size
+			}
+			if data, err := decodeContent(rel, e.value, kr, limit); err != nil {
+				if isEncrypted(e.value) && kr == nil {
+					skipped++
+				} else {
+					report("corrupt", e.key, err)
+				}
+			} else if err = checkDigest(data, e.digest, e.meta); err != nil {
+				report("corrupt", e.key, err)
+			}
+		}
+		if root != "" {
+			fn := filepath.Join(root, rel)
+			if err := verifyLocalEntry(fn, e); os.IsNotExist(err) {
+				report("missing", fn, err)
+			} else if err != nil {
+				report("modified", fn, err)
+			}
+		}
+	}
+	if skipped > 0 {
+		log.warn("encrypted content is not verified in the store, no --decrypt-key given", "prefix", prefix, "files", skipped)
+	}
+	log.info("verified", "prefix", prefix, "root", root, "files", len(rels), "problems", problems)
+	if problems > 0 {
+		cmd.SilenceErrors, cmd.SilenceUsage = true, true
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// verifyLocalEntry checks the type of the local entry, and the content of a file against the stored digest
+func verifyLocalEntry(fn string, e *storedEntry) error {
+	fi, err := os.Lstat(fn)
+	if err != nil {
+		return err
+	}
+	switch {
+	case e.meta.isDir():
+		if !fi.IsDir() {
+			return errors.New("not a directory")
+		}
+	case e.meta.isSymlink():
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return errors.New("not a symlink")
+		} else if target, err := os.Readlink(fn); err != nil {
+			return err
+		} else if target != e.meta.Target {
+			return fmt.Errorf("symlink target %s does not match the stored target %s", target, e.meta.Target)
+		}
+	default:
+		if !fi.Mode().IsRegular() {
+			return errors.New("not a regular file")
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		return checkDigest(data, e.digest, e.meta)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	versionsDirName = "versions"
+	currentLinkName = "current"
+)
+
+// currentVersion returns the path of the current version directory, or empty string if there's none
+func (w *watcher) currentVersion() string {
+	target, err := os.Readlink(filepath.Join(w.root, currentLinkName))
+	if err != nil {
+		return ""
+	} else if !filepath.IsAbs(target) {
+		target = filepath.Join(w.root, target)
+	}
+	if fi, err := os.Stat(target); err != nil || !fi.IsDir() {
+		return ""
+	}
+	return target
+}
+
+// promoteVersion writes the current version with pending updates applied into a new version
+// directory, switches current link to it and runs the command, switching back if it fails
+func (w *watcher) promoteVersion(rev int64) {
+	vdir := filepath.Join(w.root, versionsDirName)
+	if err := mkdirAll(vdir, w.rootOwner, w.rootGroup, w.rootMask); err != nil {
+		w.log().error("error creating versions directory", "path", vdir, "error", err)
+		return
+	}
+	staging, err := ioutil.TempDir(vdir, ".staging")
+	if err != nil {
+		w.log().error("error creating new version", "revision", rev, "error", err)
+		return
+	}
+	defer os.RemoveAll(staging)
+	cur := w.currentVersion()
+	if cur != "" {
+		err = copyTree(cur, staging)
+	} else if err = os.Chmod(staging, os.FileMode(dirMode(w.rootMask))); err == nil && w.rootOwner >= 0 {
+		err = os.Chown(staging, w.rootOwner, w.rootGroup)
+	}
+	if err != nil {
+		w.log().error("error creating new version", "revision", rev, "error", err)
+		return
+	}
+	changes := w.applyUpdates(staging, w.pending, nil)
+	if changes.count() == 0 && cur != "" {
+		// the command may still need to run after a failure or restart
+		if w.state.Pending {
+			w.reloadVersion(rev)
+		} else {
+			w.promoted(rev)
+		}
+		return
+	}
+	abs, _ := filepath.Abs(w.root)
+	if w.checkCmd != "" && !w.runCheck(staging, abs, rev, changes) {
+		return
+	}
+	name := w.versionName(rev, filepath.Base(cur))
+	if err = os.RemoveAll(filepath.Join(vdir, name)); err == nil {
+		err = os.Rename(staging, filepath.Join(vdir, name))
+	}
+	if err == nil {
+		err = w.switchVersion(name)
+	}
+	if err != nil {
+		w.log().error("error switching to new version", "revision", rev, "error", err)
+		return
+	}
+	w.log().info("switched to new version", "revision", rev, "path", filepath.Join(vdir, name))
+	w.changes.merge(changes)
+	w.recordChanges(changes)
+	// while the command is retried, rolling back goes to the version it was first run with
+	if w.prevVersion == "" && cur != "" {
+		w.prevVersion = filepath.Base(cur)
+	}
+	w.reloadVersion(rev)
+}
+
+// versionName returns the name of the new version directory for the revision: the revision, or if
+// the current version or the one to roll back to is named so, the revision with the first free sequence
+// number, so the live version is never replaced
+func (w *watcher) versionName(rev int64, cur string) string {
+	name := strconv.FormatInt(rev, 10)
+	for n := 1; name == cur || name == w.prevVersion; n++ {
+		name = strconv.FormatInt(rev, 10) + "." + strconv.Itoa(n)
+	}
+	return name
+}
+
+// parseVersionName returns the revision and the sequence number of the version directory name
+func parseVersionName(name string) (rev int64, seq int, ok bool) {
+	var err error
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		if seq, err = strconv.Atoi(name[i+1:]); err != nil || seq <= 0 {
+			return 0, 0, false
+		}
+		name = name[:i]
+	}
+	if rev, err = strconv.ParseInt(name, 10, 64); err != nil {
+		return 0, 0, false
+	}
+	return rev, seq, true
+}
+
+// reloadVersion runs the command for the current version, switching back to the previous one if it fails
+func (w *watcher) reloadVersion(rev int64) {
+	// the command is run again after restart if the agent dies before it completes
+	w.state.Pending = true
+	w.saveState()
+	switch w.runReload(rev) {
+	case reloadRetry:
+		return
+	case reloadFailed:
+		if prev := w.prevVersion; w.rollback && prev != "" {
+			failed := w.currentVersion()
+			if err := w.switchVersion(prev); err != nil {
+				w.log().error("error switching back to previous version", "path", filepath.Join(w.root, versionsDirName, prev), "error", err)
+			} else {
+				w.log().info("switched back to previous version", "path", filepath.Join(w.root, versionsDirName, prev))
+				_ = os.RemoveAll(failed)
+				w.changes = newTreeChanges()
+			}
+		}
+		w.prevVersion = ""
+		w.state.Pending = false
+		w.saveState()
+		return
+	}
+	w.prevVersion = ""
+	w.promoted(rev)
+	w.pruneVersions()
+}
+
+// switchVersion atomically points current link to the version
+func (w *watcher) switchVersion(name string) error {
+	tmp := filepath.Join(w.root, ".temp"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	if err := os.Symlink(filepath.Join(versionsDirName, name), tmp); err != nil {
+		return err
+	}
+	if w.rootOwner >= 0 {
+		_ = os.Lchown(tmp, w.rootOwner, w.rootGroup)
+	}
+	if err := os.Rename(tmp, filepath.Join(w.root, currentLinkName)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// pruneVersions removes all but the last versions, never removing the current one
+func (w *watcher) pruneVersions() {
+	vdir := filepath.Join(w.root, versionsDirName)
+	infos, err := ioutil.ReadDir(vdir)
+	if err != nil {
+		w.log().error("error pruning versions", "error", err)
+		return
+	}
+	type version struct {
+		name string
+		rev  int64
+		seq  int
+	}
+	var versions []version
+	for _, fi := range infos {
+		if rev, seq, ok := parseVersionName(fi.Name()); ok && fi.IsDir() {
+			versions = append(versions, version{fi.Name(), rev, seq})
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].rev != versions[j].rev {
+			return versions[i].rev > versions[j].rev
+		}
+		return versions[i].seq > versions[j].seq
+	})
+	cur := filepath.Base(w.currentVersion())
+	for i := w.versions; i < len(versions); i++ {
+		if name := versions[i].name; name != cur {
+			if err = os.RemoveAll(filepath.Join(vdir, name)); err != nil {
+				w.log().error("error removing version", "path", filepath.Join(vdir, name), "error", err)
+			}
+		}
+	}
+}
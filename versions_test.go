@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPromoteVersionKeepsCurrent(t *testing.T) {
+	root := t.TempDir()
+	live := filepath.Join(root, versionsDirName, "5")
+	if err := os.MkdirAll(live, 0755); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(filepath.Join(live, "a.conf"), []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	} else if err = os.Symlink(filepath.Join(versionsDirName, "5"), filepath.Join(root, currentLinkName)); err != nil {
+		t.Fatal(err)
+	}
+	versions := 3
+	wc := &watcherConfig{name: "watcher /test", Prefix: "/test", Root: root, Command: []string{"true"}, Versions: &versions}
+	w, err := wc.newWatcher(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.loadState()
+	w.pending, w.changes, w.cmdCtx = newTreeUpdates(), newTreeChanges(), context.Background()
+	data := []byte("new\n")
+	w.pending.set("a.conf", &treeUpdate{data: data, hasData: true, digest: string(contentDigest(nil, data))})
+
+	// the tree changed at the revision the current version is named after, e.g. after a full resync
+	w.promoteVersion(5)
+	if got := filepath.Base(w.currentVersion()); got != "5.1" {
+		t.Fatalf("current version is %q, expected 5.1", got)
+	} else if content, err := ioutil.ReadFile(filepath.Join(root, currentLinkName, "a.conf")); err != nil || string(content) != "new\n" {
+		t.Fatalf("current a.conf is %q, %v", content, err)
+	} else if content, err = ioutil.ReadFile(filepath.Join(live, "a.conf")); err != nil || string(content) != "old\n" {
+		t.Fatalf("previous version a.conf is %q, %v", content, err)
+	}
+}
+
+func TestParseVersionName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rev  int64
+		seq  int
+		ok   bool
+	}{
+		{"12", 12, 0, true},
+		{"12.3", 12, 3, true},
+		{"12.0", 0, 0, false},
+		{"12.", 0, 0, false},
+		{".staging123", 0, 0, false},
+		{"current", 0, 0, false},
+	} {
+		rev, seq, ok := parseVersionName(tc.name)
+		if rev != tc.rev || seq != tc.seq || ok != tc.ok {
+			t.Errorf("parseVersionName(%q) = %d, %d, %v, expected %d, %d, %v", tc.name, rev, seq, ok, tc.rev, tc.seq, tc.ok)
+		}
+	}
+}
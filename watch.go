@@ -2,61 +2,237 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"github.com/golang/snappy"
 	"github.com/mattn/go-shellwords"
 	"github.com/spf13/cobra"
 	"go.etcd.io/etcd/clientv3"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
-	"os/user"
-	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 var (
-	watchPrefix string
-	keepalivedFifo string
-	keepalivedPrefix string
+	watchConfigFile    string
+	watchPrefix        string
+	keepalivedFifo     string
+	keepalivedPrefix   string
 	keepalivedInstance string
+	watchFileMeta      string
+	watchPrune         string
+	watchStateDir      string
+	watchQuietPeriod   time.Duration
+	watchMaxDelay      time.Duration
+	watchMinInterval   time.Duration
+	watchChecks        []string
+	watchRollback      bool
+	watchVersions      int
+	watchShutdownGrace time.Duration
+	watchReloadTimeout time.Duration
+	watchReloadFailure string
+	watchReloadRetries int
+	watchReloadBackoff time.Duration
+	watchChangesTo     string
+	watchStatusName    string
+	watchStatusTTL     time.Duration
+	watchMetricsListen string
+	watchHealthListen  string
+	watchDecryptKeys   []string
+	watchTrustedKeys   []string
+	// number of commands terminated on shutdown
+	interruptedCommands int32
+)
+
+const (
+	watchRetryDelay         = time.Second
+	defaultShutdownGrace    = 10 * time.Second
+	commandTerminateTimeout = 5 * time.Second
+)
+
+const (
+	pruneAll     = "all"
+	pruneManaged = "managed"
+	pruneNone    = "none"
 )
 
 func newWatchCommand() *cobra.Command {
+	hostname, _ := os.Hostname()
 	cmd := &cobra.Command{
-		Use:   "watch [flags] [-- <prefix> <root[:owner[:group[:mode]]]> <command> [<arg> ...] ]+",
+		Use:   "watch [flags] { --config <file> | [-- <prefix> <root[:owner[:group[:mode]]]> <command> [<arg> ...] ]+ }",
 		Short: "watches for changes in the story, synchronise with local file system and runs a command",
 		Long: `watch command sets up a number of watchers waiting for changes under the prefix key,
 synchronise store content to the local directory, and runs a local command (presumably, to reload 
 certain service)
 
 watch command also performs initial synchronisation and runs command if any file has been updated.
+Changes coming in bursts are coalesced into a single command run with --quiet-period and --max-delay,
+and --min-reload-interval limits how often the command may run.
+
+The last applied store revision is kept in --state-dir, so after restart watch command resumes from it
+instead of full synchronisation (which is still performed if the revision has been compacted).
+
+File modes and ownership are taken from the metadata stored by put command, falling back to the
+root[:owner[:group[:mode]]] defaults. --file-meta=mode only applies stored modes, and --file-meta=ignore
+always uses the defaults.
+
+On initial synchronisation, watch command removes everything in the root directory which is missing from
+the store (or, with --prune=managed, only files it has written before, as recorded in --state-dir).
+Nothing is removed if there's neither any file nor a tree generation stored under the prefix, so an
+empty or mistyped prefix does not wipe the root.
+
+Directories and symbolic links stored by put command are recreated as well, symbolic links to absolute
+paths or pointing outside of the root are refused.
+
+With --check <prefix>=<command line>, the changes of the watcher are first applied to a staged copy of its
+root, and the check command is run against it ({staging} and {root} in the command line are replaced with
+the staged copy and the root directory paths); the changes are only applied to the root if the check
+succeeds. If the command fails after the changes are applied, the previous files are restored (unless
+--rollback=false), and the changes are retried with the next update.
+
+With --versions N, every update is written into a new <root>/versions/<revision> directory, which becomes
+current by atomically switching <root>/current symbolic link to it, so readers never see partial updates.
+The last N versions are kept, and rolling back is switching the link to a previous one (the staged copy
+for --check is then the new version directory itself).
 
 watch command may also listens for keepalived (http://www.keepalived.org) events FIFO and updates
 keepalived state in the etcd store 
 
+Instead of the command line, watchers may be defined in the YAML --config file. Its top level settings
+are named as watch command flags, client section holds the global flags (connection settings), and
+the flags given in the command line take precedence over the file:
+
+  prefix: /etc
+  state-dir: /var/lib/confsync
+  client:
+    endpoints: [10.0.0.1:2379, 10.0.0.2:2379]
+    cacert: /etc/ssl/etcd-ca.pem
+  keepalived:
+    fifo: /run/ka
+    instance: master
+    key: state
+  watchers:
+    - prefix: nginx
+      root: /etc/nginx
+      owner: root
+      group: root
+      mode: "0644"
+      command: sv reload nginx
+      check: nginx -t -c {staging}/nginx.conf
+      env:
+        SVDIR: /etc/service
+      quiet-period: 2s
+
+Watchers may also override prune, file-meta, versions, rollback, max-delay, min-reload-interval and
+reload-timeout, reload-failure, reload-retries, reload-backoff and changes.
+
+On SIGHUP, watch command reads watcher definitions again (from the config file or the command line) and
+starts new watchers, stops removed ones, and restarts the ones with changed settings, synchronising their
+roots from scratch. Client and keepalived settings are only read on start.
+
+The command (as well as the check command) is terminated if it runs longer than --reload-timeout.
+If the command fails, --reload-failure policy decides what's next: with rerun, the previous files are
+restored (see --rollback) and the command is run again with the next change; retry runs the command again
+up to --reload-retries times, waiting --reload-backoff doubled with every attempt, before rolling back;
+unhealthy is the same as rerun, but also marks the watcher unhealthy until the command succeeds; and
+ignore keeps the changes as if the command succeeded.
+
+Commands are run with CONFSYNC_PREFIX, CONFSYNC_ROOT and CONFSYNC_REVISION environment variables set to
+the watcher prefix, root directory and the store revision being applied (and CONFSYNC_VERSION with
+--versions), CONFSYNC_CHANGED and CONFSYNC_REMOVED list the paths (relative to the root, one per line)
+updated and removed since the command last succeeded. Lists longer than 64KiB are left out, and
+CONFSYNC_CHANGES_TRUNCATED=1 is set instead. With --changes=file, the changes are also written to a temporary
+file named in CONFSYNC_CHANGES_FILE, and with --changes=stdin the command reads them from its standard
+input, one per line as "U <path>" for updated and "D <path>" for removed paths. The check command gets
+the same variables, with CONFSYNC_STAGING set to the staged copy of the root.
+
+Before writing a file, watchers check its content against the digest put command stores along with
+it. Files which don't match are quarantined: they are not written, the previous files are kept, and
+the error is logged and reported in the watcher status until the file is updated again (see also
+verify command).
+
+Each watcher reports the last applied store revision, the digest of the applied tree and the last command
+result in <prefix>/.confsync/status/<--status-name>-<root digest> key (so watchers of the same prefix
+with different roots report separately), bound to a lease of --status-ttl, so the key is gone when the
+agent is (see status command, and put --wait). Status settings are only read on start.
+
+With --metrics-listen, watch command serves Prometheus metrics at /metrics: files updated, removed and quarantined,
+command runs, failures and run time, the last applied revision per watcher, watch reconnects and
+cancellations, keepalived events processed and failed etcd requests.
+
+With --health-listen, watch command serves /healthz, which responds with 503 status unless the etcd
+cluster is reachable and all watchers are watching their prefixes, and /status with the state of
+each watcher (the last applied revision, the last response from the store and the last command
+result, as in its status key) and of keepalived instances in JSON. Both listen addresses are only
+read on start.
+
+Encrypted file content (see put --encrypt-key and --recipient) is decrypted with --decrypt-key files,
+which are read again on SIGHUP. If none of the keys a file is encrypted with is given, the file is
+not written and the error is logged, the previous file content is kept.
+
+Watchers read file digests and metadata from the tree manifest, if the tree is stored in format 2
+(see put --format), and refuse to apply trees stored in a newer format than they support. File
+content is decompressed with the codec recorded in the stored value (see put --compression), values
+stored by earlier versions are snappy-encoded.
+
+With --trusted-keys, watchers refuse to apply the tree unless its manifest (see put --sign-key) is
+signed with one of the keys, every updated file matches its digest in the manifest, and no file
+listed in it is removed. Refused changes are kept pending, reported in the
+watcher status and retried with the next change. Trusted keys are read again on SIGHUP.
+
+When run by systemd as a Type=notify service, watch command sends READY=1 once every watcher has
+synchronized its root, run the command if needed, and established its watch, then keeps the service
+status text updated with the last applied revision of each watcher, and with WatchdogSec set, notifies
+the watchdog while the agent is healthy (as reported by /healthz).
+
+On SIGTERM, SIGINT or SIGQUIT, watch command stops all watchers and waits for running commands up to
+--shutdown-grace (or until the signal is repeated), then terminates them with SIGTERM, and with SIGKILL
+if they are still running 5 seconds later. If any command has been terminated, watch command exits
+with status 1. Watchers removed or restarted on SIGHUP are stopped the same way.
+
 Example:
 confsync watch --prefix /etc/firewall --ka-fifo /run/ka --ka-instance master --ka-key state \
       -- keepalived /services/keepalived/config sv reload keepalived 
 
 `,
 		RunE: watchCommandFunc,
-		Args: cobra.MinimumNArgs(3),
 	}
+	cmd.Flags().StringVar(&watchConfigFile, "config", "", "YAML config `file` defining watchers and settings")
 	cmd.Flags().StringVar(&watchPrefix, "prefix", "", "common `key` prefix for all watches and keepalived status")
 	cmd.Flags().StringVar(&keepalivedFifo, "ka-fifo", "", "`path` to keepalived events FIFO")
 	cmd.Flags().StringVar(&keepalivedInstance, "ka-instance", "", "keepalived instance `name`")
 	cmd.Flags().StringVar(&keepalivedPrefix, "ka-key", "", "`key` prefix to store keepalived status (joined with --prefix, if set)")
+	cmd.Flags().StringVar(&watchPrune, "prune", pruneAll, "what to remove from watcher roots on initial sync if missing from the store: all, managed (only files written by confsync before) or none")
+	cmd.Flags().StringVar(&watchStateDir, "state-dir", defaultStateDir, "`directory` to keep local watcher state in (empty to disable)")
+	cmd.Flags().DurationVar(&watchQuietPeriod, "quiet-period", 0, "`time` to wait for more changes before running the command")
+	cmd.Flags().DurationVar(&watchMaxDelay, "max-delay", 0, "maximum `time` to postpone the command while changes keep coming (0 for no limit)")
+	cmd.Flags().DurationVar(&watchMinInterval, "min-reload-interval", 0, "minimum `time` between subsequent command runs")
+	cmd.Flags().StringArrayVar(&watchChecks, "check", nil, "`prefix=command` to check the staged watcher tree before applying the changes (may be repeated)")
+	cmd.Flags().BoolVar(&watchRollback, "rollback", true, "restore the previous files if the command fails")
+	cmd.Flags().IntVar(&watchVersions, "versions", 0, "keep `N` versions of watcher trees under <root>/versions and switch <root>/current symlink between them (0 to update files in place)")
+	cmd.Flags().DurationVar(&watchReloadTimeout, "reload-timeout", 0, "`time` limit for the command and the check command runs (0 for no limit)")
+	cmd.Flags().StringVar(&watchReloadFailure, "reload-failure", reloadFailureRerun, "what to do if the command fails: rerun (with the next change), retry, unhealthy (mark the watcher unhealthy and rerun with the next change) or ignore")
+	cmd.Flags().IntVar(&watchReloadRetries, "reload-retries", defaultReloadRetries, "number of `times` to retry the failed command with --reload-failure=retry")
+	cmd.Flags().DurationVar(&watchReloadBackoff, "reload-backoff", defaultReloadBackoff, "`time` to wait before retrying the failed command, doubled with every retry")
+	cmd.Flags().StringVar(&watchChangesTo, "changes", changesToEnv, "how to pass the list of changes to commands besides CONFSYNC_CHANGED and CONFSYNC_REMOVED variables: env (only variables), file or stdin")
+	cmd.Flags().StringVar(&watchStatusName, "status-name", hostname, "`name` of the agent status key")
+	cmd.Flags().DurationVar(&watchStatusTTL, "status-ttl", defaultStatusTTL, "`time` to keep the agent status keys after the agent is gone (0 disables status reporting)")
+	cmd.Flags().StringVar(&watchMetricsListen, "metrics-listen", "", "`address` to serve Prometheus metrics on (e.g. :9090)")
+	cmd.Flags().StringVar(&watchHealthListen, "health-listen", "", "`address` to serve /healthz and /status on (may be the same as --metrics-listen)")
+	cmd.Flags().StringArrayVar(&watchTrustedKeys, "trusted-keys", nil, "`file` of public keys, one per line, tree manifests must be signed with (may be repeated)")
+	cmd.Flags().StringArrayVar(&watchDecryptKeys, "decrypt-key", nil, "key `file` to decrypt stored file content with, a shared secret or a recipient key (may be repeated)")
+	cmd.Flags().DurationVar(&watchShutdownGrace, "shutdown-grace", defaultShutdownGrace, "`time` to wait for running commands on shutdown before terminating them")
+	cmd.Flags().StringVar(&watchFileMeta, "file-meta", fileMetaApply, "how to apply stored file metadata: apply (mode and ownership), mode (mode only) or ignore (use root defaults)")
 	return cmd
 }
 
@@ -68,266 +244,439 @@ type watcher struct {
 	rootMask  int
 	cmd       string
 	args      []string
+	checkCmd  string
+	checkArgs []string
+	env       []string
+	rollback  bool
+	// number of versioned tree copies to keep, 0 if the tree is updated in place
+	versions int
+	// set once the tree under the prefix is known to be uploaded with a generation key,
+	// file updates then are considered complete only when the generation is updated
+	generations bool
+	fileMeta    string
+	prune       string
+	// keys to decrypt the stored content with
+	keys *keyring
+	// keys the tree manifest must be signed with, if set, and the last manifest verified
+	trusted     *trustedKeys
+	manifest    *treeManifest
+	manifestErr error
+	// files not written, as their content does not match the stored digest, with the reasons
+	quarantined map[string]string
+	statePath   string
+	state       *watchState
+	// updates received, but not yet applied to the root
+	pending *treeUpdates
+	reload  reloadScheduler
+	// set if the watcher replaces one with different settings, so the root is synchronized from scratch
+	resync bool
+	// canceled when the watcher is stopped, no commands are started then
+	stopCtx context.Context
+	// commands are terminated when done
+	cmdCtx context.Context
+	// reload command failure handling
+	reloadTimeout time.Duration
+	reloadFailure string
+	reloadRetries int
+	reloadBackoff time.Duration
+	attempt       int
+	backup        *treeBackup
+	prevVersion   string
+	unhealthy     int32
+	// changes made since the command last succeeded, and how they are passed to commands
+	changes   *treeChanges
+	changesTo string
+	// status reporting and the last command result
+	status         *statusReporter
+	lastCommand    string
+	lastExitStatus int
+	lastError      string
+	health         *watcherHealth
+	// the last revision the generation or the manifest of the tree was updated at, and the
+	// revision last reported in the status
+	treeRevision     int64
+	reportedRevision int64
+	// closed once the watcher has synchronized its root and established its watch, or has stopped
+	ready chan struct{}
 }
 
-func (w *watcher) runCmd() {
-	cmd := exec.Cmd{
-		Path:   w.cmd,
-		Args:   w.args,
-		Dir:    w.root,
-		Env:    os.Environ(),
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+// settings returns a copy of the watcher without its runtime state, for comparing watcher definitions
+func (w *watcher) settings() watcher {
+	s := *w
+	s.generations, s.state, s.pending, s.resync, s.stopCtx, s.cmdCtx = false, nil, nil, false, nil, nil
+	s.attempt, s.backup, s.prevVersion, s.unhealthy, s.changes = 0, nil, "", 0, nil
+	s.status, s.lastCommand, s.lastExitStatus, s.lastError, s.health, s.ready = nil, "", 0, "", nil, nil
+	s.manifest, s.manifestErr, s.quarantined, s.treeRevision, s.reportedRevision = nil, nil, nil, 0, 0
+	s.reload = reloadScheduler{
+		quietPeriod: w.reload.quietPeriod,
+		maxDelay:    w.reload.maxDelay,
+		minInterval: w.reload.minInterval,
 	}
-	if err := cmd.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "error running command %s: %s\n", w.cmd, err)
+	return s
+}
+
+// check applies pending updates to a staged copy of the root and runs the check command against it
+func (w *watcher) check(rev int64) bool {
+	root, err := filepath.Abs(w.root)
+	if err != nil {
+		w.log().error("error staging root", "revision", rev, "error", err)
+		return false
+	}
+	staging, err := ioutil.TempDir(filepath.Dir(root), "."+filepath.Base(root)+".staging")
+	if err != nil {
+		w.log().error("error staging root", "revision", rev, "error", err)
+		return false
+	}
+	defer os.RemoveAll(staging)
+	if err = copyTree(root, staging); err != nil {
+		w.log().error("error staging root", "revision", rev, "path", staging, "error", err)
+		return false
 	}
+	changes := w.applyUpdates(staging, w.pending, nil)
+	return w.runCheck(staging, root, rev, changes)
 }
 
-func keyRelPath(prefix string, key string) (string, bool) {
-	if key == prefix {
-		return filepath.Base(key), true
-	} else if rel, err := filepath.Rel(prefix, key); err != nil || strings.HasPrefix(rel, "../") || filepath.Base(rel) == ".hash" {
-		return "", false
-	} else {
-		return rel, true
+// promote applies pending updates to the root and runs the command, rolling the root back
+// if the command fails
+func (w *watcher) promote(rev int64) {
+	if !w.pending.empty() {
+		if err := w.resolvePending(); err != nil {
+			w.log().error("refusing to apply the tree", "revision", rev, "error", err)
+			w.recordCommand(commandRefused, err)
+			w.reportStatus()
+			return
+		} else if w.awaitsManifest() {
+			w.log().info("waiting for the tree manifest to apply the tree", "revision", rev)
+			return
+		} else if w.lastCommand == commandRefused {
+			w.lastCommand, w.lastExitStatus, w.lastError = "", 0, ""
+		}
+	}
+	w.quarantine()
+	if w.versions > 0 {
+		w.promoteVersion(rev)
+		return
+	}
+	if w.checkCmd != "" && !w.pending.empty() && !w.check(rev) {
+		return
+	}
+	// the backup is kept while the command is retried, to restore the files it was first run with
+	if w.backup == nil && w.rollback {
+		w.backup = newTreeBackup()
+	}
+	changes := w.applyUpdates(w.root, w.pending, w.backup)
+	w.changes.merge(changes)
+	w.recordChanges(changes)
+	if changes.count() > 0 || w.state.Pending {
+		// the command is run again after restart if the agent dies before it completes
+		w.state.Pending = true
+		w.saveState()
+		switch w.runReload(rev) {
+		case reloadRetry:
+			return
+		case reloadFailed:
+			if w.backup != nil {
+				w.log().warn("rolling back changes", "revision", rev)
+				w.backup.restore(w.root)
+				w.changes = newTreeChanges()
+			}
+			w.backup = nil
+			w.state.Pending = false
+			w.saveState()
+			return
+		}
 	}
+	w.backup = nil
+	w.promoted(rev)
+}
+
+// promoted records pending updates as applied up to the revision
+func (w *watcher) promoted(rev int64) {
+	w.trackUpdates(w.pending)
+	w.pending = newTreeUpdates()
+	w.changes = newTreeChanges()
+	w.state.Pending = false
+	w.updateRevision(rev)
+	w.reportStatus()
 }
 
-func (w *watcher) initialSync(c *clientv3.Client) int {
-	resp, err := c.Get(context.Background(), w.prefix, clientv3.WithPrefix())
+// fullSync reads the whole tree into pending updates, along with removals of stale
+// local entries, and returns the store revision
+func (w *watcher) fullSync(ctx context.Context, c *clientv3.Client) (int64, error) {
+	resp, err := c.Get(ctx, w.prefix, clientv3.WithPrefix())
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "initial sync failed for prefix %s root %s: %s\n", w.prefix, w.root, err)
-		return 0
+		return 0, err
 	}
-	cnt := 0
+	w.generations = false
+	w.setManifest(nil)
+	updates := newTreeUpdates()
+	tree := make(map[string]bool)
+	genKey, manKey := internalKey(w.prefix, generationKey), internalKey(w.prefix, manifestKey)
 	for _, kv := range resp.Kvs {
-		if key, ok := keyRelPath(w.prefix, string(kv.Key)); ok {
-			fn := filepath.Join(w.root, key)
-			if data, err := snappy.Decode(nil, kv.Value); err != nil {
-				fmt.Fprintf(os.Stderr, "error decompressing file %s content, skipping: %s", fn, err)
-			} else if updated, err := w.maybeUpdateFile(fn, data); err != nil {
-				fmt.Fprintf(os.Stderr, "failed to synchronize file %s: %s\n", fn, err)
-			} else if updated {
-				cnt++
-			}
+		if string(kv.Key) == genKey {
+			w.generations = true
+		} else if string(kv.Key) == manKey {
+			w.setManifest(kv.Value)
+		} else {
+			updates.add(w.prefix, kv, false, w.keys)
+		}
+	}
+	for _, kv := range resp.Kvs {
+		if rel, attr, ok := w.manifest.keyPath(w.prefix, string(kv.Key)); ok && attr == "" {
+			tree[rel] = true
 		}
 	}
-	return cnt
+	switch {
+	case w.prune == pruneNone:
+	case len(tree) == 0 && !w.generations:
+		// an empty or mistyped prefix must not wipe the root
+		w.log().warn("nothing is stored under the prefix, not pruning the root", "prune", w.prune)
+	case w.prune == pruneAll:
+		w.pruneRoot(tree, updates)
+	case w.prune == pruneManaged:
+		w.pruneManaged(tree, updates)
+	}
+	w.pending = updates
+	return resp.Header.Revision, nil
 }
 
-func mkdirAll(path string, owner, group, mode int) error {
-	if mode == -1 {
-		mode = 0755
-	} else {
-		for i := 0; i < 3; i++ {
-			if (mode & 4 << uint(i * 3)) != 0 {
-				mode |= 1 << uint(i * 3)
-			}
+// pruneManaged removes entries previously written by the watcher, which are no longer in the tree
+func (w *watcher) pruneManaged(tree map[string]bool, updates *treeUpdates) {
+	for rel := range w.state.Entries {
+		if !tree[rel] {
+			updates.remove(rel)
 		}
 	}
-	dir, err := os.Stat(path)
-	if err == nil {
-		if dir.IsDir() {
-			return nil
+}
+
+// pruneRoot removes everything under the watcher root, which is not in the tree
+func (w *watcher) pruneRoot(tree map[string]bool, updates *treeUpdates) {
+	keep := make(map[string]bool, len(tree))
+	for rel := range tree {
+		for d := rel; d != "." && d != "/" && !keep[d]; d = filepath.Dir(d) {
+			keep[d] = true
 		}
-		return fmt.Errorf("%s is not a directory", path)
 	}
-	elts := make([]string, 1, 8)
-	elts[0] = path
-	d := path
-	for {
-		d = filepath.Dir(d)
-		if d == "." || d == "/" {
-			break
-		}
-		dir, err = os.Stat(d)
-		if err == nil {
-			if dir.IsDir() {
-				break
-			} else {
-				return fmt.Errorf("%s is not a directory", d)
-			}
+	root, err := filepath.Abs(w.root)
+	if err != nil {
+		w.log().error("error pruning root", "error", err)
+		return
+	} else if w.versions > 0 {
+		// versions are pruned against the current one
+		if root = w.currentVersion(); root == "" {
+			return
 		}
-		elts = append(elts, d)
 	}
-	for i := len(elts) - 1; i >= 0; i-- {
-		err = os.Mkdir(elts[i], os.FileMode(mode))
+	_ = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
-			return fmt.Errorf("error creating directory %s: %s", elts[i], err)
-		}
-		if owner >= 0 {
-			if err = os.Chown(elts[i], owner, group); err != nil {
-				return fmt.Errorf("error chown %s: %s", elts[i], err)
+			if !os.IsNotExist(err) {
+				w.log().error("error pruning root", "path", p, "error", err)
 			}
+			return nil
+		} else if p == root {
+			return nil
+		} else if info.IsDir() && w.statePath != "" && p == filepath.Dir(w.statePath) {
+			return filepath.SkipDir
 		}
-	}
-	return nil
+		if rel, _ := filepath.Rel(root, p); !keep[rel] {
+			updates.remove(rel)
+		}
+		return nil
+	})
 }
 
-func (w *watcher) maybeUpdateFile(path string, content []byte) (bool, error) {
-	var p = filepath.Dir(path)
-	if fi, err := os.Stat(path); err == nil {
-		if fi.IsDir() {
-			return false, fmt.Errorf("error updating file: %s is a direcotry", path)
-		} else if fileContent, err := ioutil.ReadFile(path); err == nil {
-			if bytes.Compare(fileContent, content) == 0 {
-				return false, nil
-			}
-		}
-	} else {
-		if fi, err := os.Stat(p); err == nil {
-			if !fi.IsDir() {
-				return false, fmt.Errorf("error updating %s: %s is not a directory", path, p)
-			}
-		} else if err = mkdirAll(p, w.rootOwner, w.rootGroup, w.rootMask); err != nil {
-			return false, fmt.Errorf("error updating %s: can't create directory %s: %s", path, p, err)
-		}
-	}
-	if f, err := ioutil.TempFile(p, ".temp*"); err != nil {
-		return false, fmt.Errorf("error updating %s: %s", path, err)
-	} else if _, err = f.Write(content); err != nil {
-		_ = syscall.Unlink(f.Name())
-		return false, fmt.Errorf("error updating %s: %s", path, err)
-	} else if err = f.Close(); err != nil {
-		_ = syscall.Unlink(f.Name())
-		return false, fmt.Errorf("error updating %s: %s", path, err)
-	} else {
-		if err = os.Chmod(f.Name(), os.FileMode(w.rootMask)); err != nil {
-			_ = syscall.Unlink(f.Name())
-			return false, fmt.Errorf("error setting permissions on file %s: %s", path, err)
-		}
-		if w.rootOwner >= 0 {
-			if err = os.Chown(f.Name(), w.rootOwner, w.rootGroup); err != nil {
-				_ = syscall.Unlink(f.Name())
-				return false, fmt.Errorf("error setting ownership on file %s: %s", path, err)
-			}
-		}
-		if err = os.Rename(f.Name(), path); err != nil {
-			_ = syscall.Unlink(f.Name())
-			return false, fmt.Errorf("error updating %s: %s", path, err)
+func (w *watcher) loadState() {
+	w.state = &watchState{Prefix: w.prefix, Root: w.root, Entries: make(map[string]string), Dirs: make(map[string]bool)}
+	if w.statePath != "" {
+		var err error
+		if w.state, err = loadState(w.statePath, w.prefix, w.root); err != nil {
+			w.log().error("error loading state", "path", w.statePath, "error", err)
 		}
 	}
-	return true, nil
 }
 
-func maybeRemoveDir(path string) (bool, error) {
-	df, err := os.OpenFile(path, os.O_RDONLY, 0)
-	if err != nil {
-		return false, fmt.Errorf("error reading dir %s: %s", path, err)
-	}
-	defer df.Close()
-	if dn, err := df.Readdirnames(1); err != nil && err != io.EOF {
-		return false, fmt.Errorf("error reading dir %s: %s", path, err)
-	} else if len(dn) != 0 {
-		return false, nil
-	} else if err = syscall.Rmdir(path); err != nil {
-		return false, fmt.Errorf("error removing dir %s: %s", path, err)
-	} else {
-		return true, nil
+func (w *watcher) saveState() {
+	if w.statePath != "" {
+		if err := w.state.save(w.statePath); err != nil {
+			w.log().error("error saving state", "path", w.statePath, "error", err)
+		}
 	}
 }
 
-func (w *watcher) run(c *clientv3.Client, wg *sync.WaitGroup) {
-	defer wg.Done()
-	ch := clientv3.NewWatcher(c).Watch(clientv3.WithRequireLeader(context.Background()), w.prefix, clientv3.WithPrefix())
-	if w.initialSync(c) > 0 {
-		w.runCmd()
+func (w *watcher) run(ctx context.Context, c *clientv3.Client) {
+	w.stopCtx = ctx
+	w.loadState()
+	rev := w.state.Revision
+	if w.resync {
+		rev = 0
 	}
-	for resp := range ch {
-		if resp.Canceled {
-			fmt.Fprintf(os.Stderr, "watch was canceled (%v)\n", resp.Err())
+	w.generations = w.state.Generations
+	w.pending = newTreeUpdates()
+	w.changes = newTreeChanges()
+	if w.versions > 0 && w.currentVersion() == "" {
+		// nothing to apply changes to
+		rev = 0
+	}
+	w.reportStatus()
+	// reload command may be left pending by the previous run
+	if w.state.Pending {
+		w.reload.request()
+	}
+	for ctx.Err() == nil {
+		if rev == 0 {
+			r, err := w.fullSync(ctx, c)
+			if err != nil {
+				w.log().error("sync failed", "error", err)
+				metricTxnErrors.inc("sync")
+				select {
+				case <-ctx.Done():
+				case <-time.After(watchRetryDelay):
+				}
+				continue
+			}
+			rev = r
+			w.health.sync()
+			w.reload.request()
+		} else {
+			if err := w.loadManifest(ctx, c); err != nil {
+				w.log().error("error reading tree manifest", "error", err)
+				metricTxnErrors.inc("sync")
+				select {
+				case <-ctx.Done():
+				case <-time.After(watchRetryDelay):
+				}
+				continue
+			}
+		}
+		ch := c.Watch(clientv3.WithRequireLeader(ctx), w.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1), clientv3.WithCreatedNotify())
+		if rev = w.watch(ch, rev); rev != 0 && ctx.Err() == nil {
+			metricWatchReconnects.inc(w.prefix, w.root)
+			select {
+			case <-ctx.Done():
+			case <-time.After(watchRetryDelay):
+			}
 		}
-		cnt := 0
-		for _, ev := range resp.Events {
-			if key, ok := keyRelPath(w.prefix, string(ev.Kv.Key)); ok {
-				fn := path.Join(w.root, key)
-				if ev.Type == clientv3.EventTypeDelete {
-					if err := syscall.Unlink(fn); err != nil {
-						fmt.Fprintf(os.Stderr, "error removing file %s: %s\n", fn, err)
+	}
+}
+
+// watch applies watch events until the watch is canceled, returns the last applied revision
+// or 0 if full resync is required
+func (w *watcher) watch(ch clientv3.WatchChan, rev int64) int64 {
+	genKey, manKey := internalKey(w.prefix, generationKey), internalKey(w.prefix, manifestKey)
+	w.health.setWatching(true)
+	defer w.health.setWatching(false)
+	created := false
+	for {
+		select {
+		case resp, ok := <-ch:
+			if !ok {
+				return rev
+			} else if resp.CompactRevision != 0 {
+				w.log().warn("watched revision has been compacted, resynchronizing", "revision", resp.CompactRevision)
+				metricWatchCancellations.inc(w.prefix, w.root, "compacted")
+				return 0
+			} else if resp.Canceled {
+				w.log().warn("watch was canceled, resynchronizing", "revision", rev, "error", resp.Err())
+				metricWatchCancellations.inc(w.prefix, w.root, "canceled")
+				return 0
+			}
+			w.health.sync()
+			if resp.Created {
+				created = true
+				w.markReady()
+				continue
+			}
+			complete, published := !w.generations, false
+			updates := newTreeUpdates()
+			for _, ev := range resp.Events {
+				if string(ev.Kv.Key) == genKey {
+					w.generations = ev.Type == clientv3.EventTypePut
+					w.treeRevision = ev.Kv.ModRevision
+					complete, published = true, true
+				} else if string(ev.Kv.Key) == manKey {
+					w.treeRevision = ev.Kv.ModRevision
+					if ev.Type == clientv3.EventTypeDelete {
+						w.setManifest(nil)
 					} else {
-						fmt.Fprintf(os.Stdout, "removed %s\n", fn)
-						d := fn
-						for {
-							d = filepath.Dir(d)
-							if d == w.root {
-								break
-							} else if removed, err := maybeRemoveDir(d); err != nil {
-								fmt.Fprintln(os.Stderr, err.Error())
-							} else if removed {
-								fmt.Fprintf(os.Stdout, "removed %s/\n", d)
-							}
-						}
-					}
-				} else if ev.Type == clientv3.EventTypePut {
-					if data, err := snappy.Decode(nil, ev.Kv.Value); err != nil {
-						fmt.Fprintf(os.Stderr, "error decompressing file %s content, skipping: %s", fn, err)
-					} else if updated, err := w.maybeUpdateFile(fn, data); err != nil {
-						fmt.Fprintln(os.Stderr, err.Error())
-					} else if updated {
-						cnt++
+						w.setManifest(ev.Kv.Value)
 					}
+				} else {
+					updates.add(w.prefix, ev.Kv, ev.Type == clientv3.EventTypeDelete, w.keys)
 				}
 			}
+			w.pending.merge(updates)
+			// events of other keys, such as agent status ones, do not trigger the command
+			if complete && !w.pending.empty() && (!updates.empty() || published) {
+				w.reload.request()
+			}
+			if resp.Header.Revision > rev {
+				rev = resp.Header.Revision
+				if w.pending.empty() && !w.reload.pending {
+					w.updateRevision(rev)
+				}
+			}
+		case <-w.reload.arm():
+			if w.stopping() {
+				// the watch channel is closed as well, pending updates are applied after restart
+				return rev
+			}
+			w.reload.done()
+			w.promote(rev)
+			if created {
+				w.markReady()
+			}
 		}
-		if cnt > 0 {
-			w.runCmd()
-		}
 	}
 }
 
-func parseRoot(arg string) (root string, owner, group, umask int, err error) {
+// stopping tells if the watcher is being stopped
+func (w *watcher) stopping() bool {
+	return w.stopCtx != nil && w.stopCtx.Err() != nil
+}
+
+// markReady marks the watcher ready once there's no command run pending
+func (w *watcher) markReady() {
+	if !w.reload.pending {
+		w.setReady()
+	}
+}
+
+func (w *watcher) setReady() {
+	select {
+	case <-w.ready:
+	default:
+		close(w.ready)
+	}
+}
+
+// updateRevision records the revision once everything up to it is applied, and reports it if the tree
+// has been published again since the status was last reported, even with no files changed
+func (w *watcher) updateRevision(rev int64) {
+	w.state.Revision, w.state.Generations = rev, w.generations
+	w.saveState()
+	w.health.setRevision(rev)
+	metricAppliedRevision.set(float64(rev), w.prefix, w.root)
+	if w.treeRevision > w.reportedRevision {
+		w.reportStatus()
+	}
+}
+
+// parseRootSpec splits root[:owner[:group[:mode]]] watcher argument, empty owner and group
+// stand for the current user and group
+func parseRootSpec(arg string) (root, owner, group, mode string, err error) {
 	args := strings.Split(arg, ":")
-	owner, group, umask = -1, -1, 0644
-	var uid, gid string
 	switch len(args) {
 	case 4:
-		if len(args[3]) > 0 {
-			if i, e := strconv.ParseInt(args[3], 8, 8); e != nil {
-				err = fmt.Errorf("invalid file umask: %s", e)
-				return
-			} else {
-				umask = int(i)
-			}
-		}
+		mode = args[3]
 		fallthrough
 	case 3:
-		if args[2] != "" {
-			if grp, e := user.LookupGroup(args[2]); e == nil {
-				gid = grp.Gid
-			} else if grp, err = user.LookupGroupId(args[2]); e == nil {
-				gid = grp.Gid
-			} else {
-				err = fmt.Errorf("no group %s found", args[2])
-				return
-			}
-		}
+		group = args[2]
 		fallthrough
 	case 2:
-		if args[1] != "" {
-			if usr, e := user.Lookup(args[1]); e == nil {
-				uid = usr.Gid
-				if gid == "" {
-					gid = usr.Gid
-				}
-			} else if usr, e = user.LookupId(args[1]); e == nil {
-				uid = usr.Gid
-				if gid == "" {
-					gid = usr.Gid
-				}
-			} else {
-				err = fmt.Errorf("no user %s found", args[1])
-				return
-			}
-		} else {
-			if usr, e := user.Current(); e != nil {
-				err = e
-				return
-			} else {
-				uid = usr.Uid
-				if gid == "" {
-					gid = usr.Gid
-				}
+		if owner = args[1]; owner == "" {
+			owner = strconv.Itoa(os.Getuid())
+			if group == "" {
+				group = strconv.Itoa(os.Getgid())
 			}
 		}
 		fallthrough
@@ -336,63 +685,301 @@ func parseRoot(arg string) (root string, owner, group, umask int, err error) {
 	default:
 		err = fmt.Errorf("invalid root string (must be root[:owner[:group[:umask]]]): %s", arg)
 	}
-	if gid != "" {
-		if i, e := strconv.ParseInt(gid, 10, 64); e != nil {
-			err = fmt.Errorf("user.LookupGroup returned invalid group id: %s", gid)
+	return
+}
+
+// rootAttrs resolves default ownership and file mode of watcher root entries, owner and group
+// are -1 if not set, group defaults to the owner's primary group
+func rootAttrs(owner, group, mode string) (uid, gid, umask int, err error) {
+	uid, gid, umask = -1, -1, 0644
+	if mode != "" {
+		if i, e := strconv.ParseUint(mode, 8, 32); e != nil || i&^0777 != 0 {
+			err = fmt.Errorf("invalid file mode: %s", mode)
 			return
 		} else {
-			group = int(i)
+			umask = int(i)
 		}
 	}
-	if uid != "" {
-		if i, e := strconv.ParseInt(uid, 10, 64); e != nil {
-			err = fmt.Errorf("user.LookupUser returned invalid group id: %s", uid)
+	if owner != "" {
+		if uid, gid, err = lookupUser(owner); err != nil {
 			return
-		} else {
-			owner = int(i)
 		}
 	}
+	if group != "" {
+		gid, err = lookupGroup(group)
+	}
 	return
 }
 
-func watchCommandFunc(cmd *cobra.Command, args []string) error {
-	var watchers []*watcher
+// parseWatcherArgs parses [-- <prefix> <root[:owner[:group[:mode]]]> <command> [<arg> ...] ]+ arguments
+func parseWatcherArgs(args []string) ([]*watcherConfig, error) {
+	var defs []*watcherConfig
 	for len(args) > 0 {
-	Outer:
 		switch len(args) {
-		case 0:
-			return errors.New("empty watcher definition (trailing --?)")
 		case 1:
-			return errors.New("watcher root directory missing")
+			return nil, errors.New("watcher root directory missing")
 		case 2:
-			return errors.New("watcher command missing")
+			return nil, errors.New("watcher command missing")
 		}
-		cmd, err := exec.LookPath(args[2])
-		if err != nil {
-			return fmt.Errorf("error finding command %s: %s", args[2], err)
+		wc := &watcherConfig{name: "watcher " + args[0], Prefix: args[0]}
+		var (
+			mode string
+			err  error
+		)
+		if wc.Root, wc.Owner, wc.Group, mode, err = parseRootSpec(args[1]); err != nil {
+			return nil, err
+		}
+		wc.Mode = fileModeValue(mode)
+		wc.Command, args = args[2:], nil
+		for i := 1; i < len(wc.Command); i++ {
+			if wc.Command[i] == "--" {
+				wc.Command, args = wc.Command[:i], wc.Command[i+1:]
+				if len(args) == 0 {
+					return nil, errors.New("empty watcher definition (trailing --?)")
+				}
+				break
+			}
+		}
+		defs = append(defs, wc)
+	}
+	return defs, nil
+}
+
+func validateFileMeta(value string) error {
+	switch value {
+	case fileMetaApply, fileMetaMode, fileMetaIgnore:
+		return nil
+	}
+	return fmt.Errorf("invalid file-meta value %s", value)
+}
+
+func validatePrune(value string) error {
+	switch value {
+	case pruneAll, pruneNone:
+	case pruneManaged:
+		if watchStateDir == "" {
+			return errors.New("prune=managed requires --state-dir")
+		}
+	default:
+		return fmt.Errorf("invalid prune value %s", value)
+	}
+	return nil
+}
+
+// newWatcher validates the watcher definition and creates the watcher
+func (wc *watcherConfig) newWatcher(keys *keyring, trusted *trustedKeys) (*watcher, error) {
+	if wc.Prefix == "" {
+		return nil, errors.New("prefix is not set")
+	} else if wc.Root == "" {
+		return nil, errors.New("root is not set")
+	} else if len(wc.Command) == 0 {
+		return nil, errors.New("command is not set")
+	}
+	cmd, err := exec.LookPath(wc.Command[0])
+	if err != nil {
+		return nil, fmt.Errorf("error finding command %s: %s", wc.Command[0], err)
+	}
+	owner, group, umask, err := rootAttrs(wc.Owner, wc.Group, string(wc.Mode))
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{
+		prefix:        filepath.Join("/", watchPrefix, wc.Prefix),
+		root:          wc.Root,
+		rootOwner:     owner,
+		rootGroup:     group,
+		rootMask:      umask,
+		cmd:           cmd,
+		args:          wc.Command,
+		fileMeta:      watchFileMeta,
+		prune:         watchPrune,
+		keys:          keys,
+		trusted:       trusted,
+		rollback:      watchRollback,
+		versions:      watchVersions,
+		reloadTimeout: watchReloadTimeout,
+		reloadFailure: watchReloadFailure,
+		reloadRetries: watchReloadRetries,
+		reloadBackoff: watchReloadBackoff,
+		changesTo:     watchChangesTo,
+		health:        &watcherHealth{},
+		quarantined:   make(map[string]string),
+		ready:         make(chan struct{}),
+		reload: reloadScheduler{
+			quietPeriod: watchQuietPeriod,
+			maxDelay:    watchMaxDelay,
+			minInterval: watchMinInterval,
+		},
+	}
+	if len(wc.Check) > 0 {
+		if w.checkCmd, err = exec.LookPath(wc.Check[0]); err != nil {
+			return nil, fmt.Errorf("error finding check command %s: %s", wc.Check[0], err)
+		}
+		w.checkArgs = wc.Check
+	}
+	for name, value := range wc.Env {
+		w.env = append(w.env, name+"="+value)
+	}
+	sort.Strings(w.env)
+	if wc.QuietPeriod != nil {
+		w.reload.quietPeriod = time.Duration(*wc.QuietPeriod)
+	}
+	if wc.MaxDelay != nil {
+		w.reload.maxDelay = time.Duration(*wc.MaxDelay)
+	}
+	if wc.MinReloadInterval != nil {
+		w.reload.minInterval = time.Duration(*wc.MinReloadInterval)
+	}
+	if wc.FileMeta != "" {
+		if err = validateFileMeta(wc.FileMeta); err != nil {
+			return nil, err
+		}
+		w.fileMeta = wc.FileMeta
+	}
+	if wc.Prune != "" {
+		if err = validatePrune(wc.Prune); err != nil {
+			return nil, err
+		}
+		w.prune = wc.Prune
+	}
+	if wc.Versions != nil {
+		if *wc.Versions < 0 {
+			return nil, fmt.Errorf("invalid versions value %d", *wc.Versions)
+		}
+		w.versions = *wc.Versions
+	}
+	if wc.Rollback != nil {
+		w.rollback = *wc.Rollback
+	}
+	if wc.ReloadTimeout != nil {
+		w.reloadTimeout = time.Duration(*wc.ReloadTimeout)
+	}
+	if wc.ReloadFailure != "" {
+		if err = validateReloadFailure(wc.ReloadFailure); err != nil {
+			return nil, err
+		}
+		w.reloadFailure = wc.ReloadFailure
+	}
+	if wc.ReloadRetries != nil {
+		if *wc.ReloadRetries < 0 {
+			return nil, fmt.Errorf("invalid reload-retries value %d", *wc.ReloadRetries)
+		}
+		w.reloadRetries = *wc.ReloadRetries
+	}
+	if wc.ReloadBackoff != nil {
+		w.reloadBackoff = time.Duration(*wc.ReloadBackoff)
+	}
+	if wc.Changes != "" {
+		if err = validateChangesTo(wc.Changes); err != nil {
+			return nil, err
+		}
+		w.changesTo = wc.Changes
+	}
+	if watchStateDir != "" {
+		if abs, err := filepath.Abs(wc.Root); err != nil {
+			return nil, fmt.Errorf("invalid root %s: %s", wc.Root, err)
+		} else {
+			w.statePath = stateFilePath(watchStateDir, w.prefix, abs)
+		}
+	}
+	return w, nil
+}
+
+// loadWatchers reads watcher definitions from the config file or the command line arguments
+func loadWatchers(cmd *cobra.Command, args []string) ([]*watcher, error) {
+	var (
+		defs     []*watcherConfig
+		watchers []*watcher
+		err      error
+	)
+	if watchConfigFile != "" {
+		if len(args) > 0 {
+			return nil, errors.New("watchers are defined either in the config file or in the command line")
+		}
+		if defs, err = loadWatchConfig(cmd, watchConfigFile); err != nil {
+			return nil, err
+		}
+	} else if len(args) < 3 {
+		return nil, errors.New("no watchers defined")
+	} else if defs, err = parseWatcherArgs(args); err != nil {
+		return nil, err
+	}
+	if err = validateFileMeta(watchFileMeta); err != nil {
+		return nil, err
+	} else if err = validatePrune(watchPrune); err != nil {
+		return nil, err
+	} else if watchVersions < 0 {
+		return nil, fmt.Errorf("invalid --versions value %d", watchVersions)
+	} else if err = validateReloadFailure(watchReloadFailure); err != nil {
+		return nil, err
+	} else if watchReloadRetries < 0 {
+		return nil, fmt.Errorf("invalid --reload-retries value %d", watchReloadRetries)
+	} else if err = validateChangesTo(watchChangesTo); err != nil {
+		return nil, err
+	}
+	if watchStateDir != "" {
+		if dir, err := filepath.Abs(watchStateDir); err != nil {
+			return nil, fmt.Errorf("invalid --state-dir: %s", err)
+		} else {
+			watchStateDir = dir
+		}
+	}
+	checks := make(map[string]commandLine)
+	for _, check := range watchChecks {
+		i := strings.Index(check, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid --check %s (must be prefix=command)", check)
+		}
+		if args, err := shellwords.Parse(check[i+1:]); err != nil {
+			return nil, fmt.Errorf("error parsing --check command %s: %s", check[i+1:], err)
+		} else if len(args) == 0 {
+			return nil, fmt.Errorf("empty --check command for prefix %s", check[:i])
+		} else {
+			checks[check[:i]] = args
+		}
+	}
+	keys, err := loadKeyring(watchDecryptKeys)
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := loadTrustedKeys(watchTrustedKeys)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]string)
+	for _, wc := range defs {
+		if check, ok := checks[wc.Prefix]; ok {
+			wc.Check = check
+			delete(checks, wc.Prefix)
+		}
+		w, err := wc.newWatcher(keys, trusted)
+		if err == nil {
+			if other, ok := seen[w.key()]; ok {
+				err = fmt.Errorf("duplicate of %s", other)
+			}
+			seen[w.key()] = wc.name
 		}
-		root, owner, group, umask, err := parseRoot(args[1])
 		if err != nil {
-			return err
-		}
-		watcher := &watcher{
-			prefix:    filepath.Join("/", watchPrefix, args[0]),
-			root:      root,
-			rootOwner: owner,
-			rootGroup: group,
-			rootMask:  umask,
-			cmd:       cmd,
-		}
-		watchers = append(watchers, watcher)
-		for i := 3; i < len(args); i++ {
-			if args[i] == "--" {
-				watcher.args = args[2:i]
-				args = args[i+1:]
-				goto Outer
+			if watchConfigFile != "" {
+				return nil, fmt.Errorf("config %s: %s: %s", watchConfigFile, wc.name, err)
 			}
+			return nil, fmt.Errorf("%s: %s", wc.name, err)
 		}
-		watcher.args = args[2:]
-		break
+		watchers = append(watchers, w)
+	}
+	for prefix := range checks {
+		return nil, fmt.Errorf("no watcher for --check prefix %s", prefix)
+	}
+	return watchers, nil
+}
+
+func watchCommandFunc(cmd *cobra.Command, args []string) error {
+	watchers, err := loadWatchers(cmd, args)
+	if err != nil {
+		return err
+	} else if err = setupLogging(globals.logLevel, globals.logFormat); err != nil {
+		// logging may be set up in the config client section
+		return err
 	}
 	if keepalivedFifo != "" && keepalivedInstance == "" {
 		return fmt.Errorf("--ka-instance name must be set for processing keepalived events")
@@ -403,36 +990,57 @@ func watchCommandFunc(cmd *cobra.Command, args []string) error {
 			keepalivedPrefix = filepath.Join("/", watchPrefix, keepalivedPrefix)
 		}
 	}
-	return runWatchers(watchers)
+	if watchStatusTTL > 0 && watchStatusTTL < time.Second {
+		return fmt.Errorf("--status-ttl must be at least 1s")
+	}
+	cmd.SilenceErrors, cmd.SilenceUsage = true, true
+	ka := keepalivedSettings{fifo: keepalivedFifo, prefix: keepalivedPrefix, instance: keepalivedInstance}
+	return runWatchers(watchers, ka, func() ([]*watcher, error) {
+		if watchConfigFile != "" {
+			resetConfigFlags(cmd)
+		}
+		return loadWatchers(cmd, args)
+	})
 }
 
-func updateKeepalivedStatus(c *clientv3.Client, kind, instance, state string) {
+// keepalivedSettings are taken once on start, and are not changed by reloading watchers
+type keepalivedSettings struct {
+	fifo     string
+	prefix   string
+	instance string
+}
+
+func updateKeepalivedStatus(c *clientv3.Client, ka keepalivedSettings, kind, instance, state string) error {
 	var (
 		ops []clientv3.Op
 	)
-	ops = append(ops, clientv3.OpPut(filepath.Join(keepalivedPrefix, keepalivedInstance, kind, instance), state))
-	ckey := filepath.Join(keepalivedPrefix, "current", kind, instance)
+	ops = append(ops, clientv3.OpPut(filepath.Join(ka.prefix, ka.instance, kind, instance), state))
+	ckey := filepath.Join(ka.prefix, "current", kind, instance)
 	if state == "MASTER" {
-		ops = append(ops, clientv3.OpPut(ckey, keepalivedInstance))
+		ops = append(ops, clientv3.OpPut(ckey, ka.instance))
 	} else {
 		ops = append(ops, clientv3.OpTxn(
-			[]clientv3.Cmp{clientv3.Compare(clientv3.Value(ckey), "=", keepalivedInstance)},
+			[]clientv3.Cmp{clientv3.Compare(clientv3.Value(ckey), "=", ka.instance)},
 			[]clientv3.Op{clientv3.OpDelete(ckey)},
 			[]clientv3.Op{},
 		))
 	}
 	_, err := c.Txn(context.Background()).If().Then(ops...).Commit()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error updating keepalived status: %s", err)
+		log.error("error updating keepalived status", "key", filepath.Join(ka.prefix, ka.instance, kind, instance), "error", err)
+		metricTxnErrors.inc("keepalived")
+	} else {
+		log.info("keepalived status updated", "key", filepath.Join(ka.prefix, ka.instance, kind, instance), "state", state)
 	}
+	return err
 }
 
-func runKeepaliveStateUpdater(c *clientv3.Client, wg *sync.WaitGroup, stop chan struct{}) {
+func runKeepaliveStateUpdater(c *clientv3.Client, ka keepalivedSettings, kas *keepalivedState, wg *sync.WaitGroup, stop chan struct{}) {
 	var (
 		events = make(chan string)
 		parser = shellwords.NewParser()
 	)
-	go runKeepalivedEventsListener(events)
+	go runKeepalivedEventsListener(ka.fifo, events)
 Outer:
 	for {
 		select {
@@ -440,24 +1048,25 @@ Outer:
 			break Outer
 		case line := <-events:
 			if args, err := parser.Parse(line); err != nil {
-				fmt.Fprintf(os.Stderr, "error parsing keepalived event string %s: %s\n", line, err)
+				log.error("error parsing keepalived event", "event", line, "error", err)
 			} else if len(args) < 3 {
-				fmt.Fprintf(os.Stderr, "error parsing keepalived event string %s: not enought parameters\n", line)
+				log.error("error parsing keepalived event: not enough parameters", "event", line)
 			} else {
-				updateKeepalivedStatus(c, args[0], args[1], args[2])
+				kas.update(args[0], args[1], args[2], updateKeepalivedStatus(c, ka, args[0], args[1], args[2]))
+				metricKeepalivedEvents.inc(args[0], args[2])
 			}
 		}
 	}
 	wg.Done()
 }
 
-func runKeepalivedEventsListener(events chan string) {
+func runKeepalivedEventsListener(fifo string, events chan string) {
 	var wt *time.Timer
 	for {
 		if wt != nil {
 			<-wt.C
 		}
-		fd, err := os.OpenFile(keepalivedFifo, os.O_RDONLY, 0)
+		fd, err := os.OpenFile(fifo, os.O_RDONLY, 0)
 		if err != nil {
 			if wt == nil {
 				wt = time.NewTimer(1 * time.Second)
@@ -474,37 +1083,175 @@ func runKeepalivedEventsListener(events chan string) {
 	}
 }
 
-func runWatchers(w []*watcher) error {
+// runningWatcher is a watcher goroutine, which is stopped by canceling its context, and its running
+// commands are terminated by canceling the command context
+type runningWatcher struct {
+	w      *watcher
+	cancel context.CancelFunc
+	kill   context.CancelFunc
+	done   chan struct{}
+}
+
+func startWatcher(c *clientv3.Client, r *statusReporter, w *watcher) *runningWatcher {
+	ctx, cancel := context.WithCancel(c.Ctx())
+	w.status = r
+	rw := &runningWatcher{w: w, cancel: cancel, done: make(chan struct{})}
+	w.cmdCtx, rw.kill = context.WithCancel(context.Background())
+	go func() {
+		defer close(rw.done)
+		defer rw.kill()
+		defer w.setReady()
+		w.run(ctx, c)
+	}()
+	return rw
+}
+
+// stop stops the watcher, waiting for the running command for the grace period before terminating it
+func (rw *runningWatcher) stop(grace time.Duration) {
+	rw.cancel()
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-rw.done:
+		return
+	case <-timer.C:
+		rw.w.log().warn("shutdown grace period expired, terminating running commands")
+	}
+	rw.kill()
+	<-rw.done
+}
+
+// stopWatchers stops the watchers, waiting for running commands for the grace period or until
+// the next signal
+func stopWatchers(running map[string]*runningWatcher, grace time.Duration, sc chan os.Signal) {
+	done := make(chan struct{})
+	go func() {
+		for _, rw := range running {
+			<-rw.done
+		}
+		close(done)
+	}()
+	for _, rw := range running {
+		rw.cancel()
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+		log.warn("shutdown grace period expired, terminating running commands")
+	case <-sc:
+		log.warn("terminating running commands")
+	}
+	for _, rw := range running {
+		rw.kill()
+	}
+	<-done
+}
+
+// key identifies the watcher between reloads, as its state file does
+func (w *watcher) key() string {
+	root, _ := filepath.Abs(w.root)
+	return w.prefix + "\x00" + root
+}
+
+// reloadWatchers starts new watchers, stops removed ones and restarts the ones with changed settings
+func reloadWatchers(c *clientv3.Client, r *statusReporter, running map[string]*runningWatcher, watchers []*watcher) map[string]*runningWatcher {
+	next := make(map[string]*runningWatcher, len(watchers))
+	for _, w := range watchers {
+		key := w.key()
+		if rw, ok := running[key]; !ok {
+			w.log().info("starting watcher")
+			next[key] = startWatcher(c, r, w)
+		} else if reflect.DeepEqual(rw.w.settings(), w.settings()) {
+			next[key] = rw
+		} else {
+			w.log().info("restarting watcher with new settings")
+			rw.stop(watchShutdownGrace)
+			w.resync = true
+			next[key] = startWatcher(c, r, w)
+		}
+	}
+	for key, rw := range running {
+		if _, ok := next[key]; !ok {
+			rw.w.log().info("stopping watcher")
+			rw.stop(watchShutdownGrace)
+			rw.w.deleteMetrics()
+			if r != nil {
+				r.remove(r.key(rw.w))
+			}
+		}
+	}
+	return next
+}
+
+// runWatchers runs the watchers until terminated, reloading them with the load function on SIGHUP
+func runWatchers(watchers []*watcher, ka keepalivedSettings, load func() ([]*watcher, error)) error {
 	c := mustClient()
+	h := &agentHealth{c: c, ka: ka}
+	if ka.fifo != "" {
+		h.kaState = newKeepalivedState()
+	}
+	servers, err := serveAgent(h, watchMetricsListen, watchHealthListen)
+	if err != nil {
+		_ = c.Close()
+		return err
+	}
 	wg := &sync.WaitGroup{}
 	dc := make(chan struct{})
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
-	if keepalivedFifo != "" {
+	if ka.fifo != "" {
 		wg.Add(1)
-		go runKeepaliveStateUpdater(c, wg, dc)
+		go runKeepaliveStateUpdater(c, ka, h.kaState, wg, dc)
 	}
-	for i := range w {
+	var r *statusReporter
+	if watchStatusTTL > 0 {
+		r = newStatusReporter(c, watchStatusName, watchStatusTTL)
+		r.start()
+	}
+	// the notifier unsets the systemd environment, so it must be created before any command is started
+	n := newSdNotifier()
+	running := reloadWatchers(c, r, nil, watchers)
+	h.setWatchers(running)
+	if n != nil {
 		wg.Add(1)
-		go w[i].run(c, wg)
+		go func() {
+			defer wg.Done()
+			n.run(h, dc)
+		}()
 	}
-Loop:
-	for {
-		sig := <-sc
-		switch sig {
-		case syscall.SIGHUP:
-			break Loop
-		case syscall.SIGINT:
-			break Loop
-		case syscall.SIGTERM:
-			break Loop
-		case syscall.SIGQUIT:
-			break Loop
+	for sig := range sc {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if watchers, err := load(); err != nil {
+			log.error("error reloading watchers, keeping the current ones", "error", err)
+		} else {
+			running = reloadWatchers(c, r, running, watchers)
+			h.setWatchers(running)
 		}
 	}
-	signal.Stop(sc)
 	close(dc)
-	err := c.Close()
+	if n != nil {
+		n.notify("STOPPING=1")
+	}
+	stopWatchers(running, watchShutdownGrace, sc)
+	signal.Stop(sc)
+	for _, srv := range servers {
+		_ = srv.Close()
+	}
+	if r != nil {
+		r.stop()
+	}
+	err = c.Close()
 	wg.Wait()
-	return err
+	if err != nil {
+		return err
+	} else if n := atomic.LoadInt32(&interruptedCommands); n > 0 {
+		log.error("commands interrupted on shutdown", "count", n)
+		return exitStatus(1)
+	}
+	return nil
 }
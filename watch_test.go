@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/embed"
+)
+
+// freePort returns a local port nothing listens on
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startEtcd starts a single member etcd server in a temporary directory, and returns its client URL
+func startEtcd(t *testing.T) string {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.Logger, cfg.LogLevel, cfg.LogOutputs = "zap", "error", []string{"stderr"}
+	cu, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	pu, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*cu}, []url.URL{*cu}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*pu}, []url.URL{*pu}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatal("etcd server has not started in time")
+	}
+	return cu.String()
+}
+
+// runConfsync runs the command line, with flags of previous runs reset to their defaults
+func runConfsync(args ...string) error {
+	var reset func(cmd *cobra.Command)
+	reset = func(cmd *cobra.Command) {
+		cmd.Flags().VisitAll(func(f *pflag.Flag) {
+			if sv, ok := f.Value.(pflag.SliceValue); ok {
+				_ = sv.Replace(nil)
+			} else {
+				_ = f.Value.Set(f.DefValue)
+			}
+			f.Changed = false
+		})
+		for _, sub := range cmd.Commands() {
+			reset(sub)
+		}
+	}
+	reset(rootCmd)
+	rootCmd.SetArgs(args)
+	return rootCmd.Execute()
+}
+
+func TestPutWaitUnchangedTree(t *testing.T) {
+	endpoint := startEtcd(t)
+	src, root := t.TempDir(), t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, "a.conf"), []byte("a = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "sign.key")
+	if err := runConfsync("keygen", "--sign", keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := newStatusReporter(c, "test", defaultStatusTTL)
+	r.start()
+	defer r.stop()
+	wc := &watcherConfig{name: "watcher /test", Prefix: "/test", Root: root, Command: []string{"true"}}
+	w, err := wc.newWatcher(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := startWatcher(c, r, w)
+	defer rw.stop(time.Second)
+	select {
+	case <-w.ready:
+	case <-time.After(10 * time.Second):
+		t.Fatal("watcher is not ready in time")
+	}
+
+	if err := runConfsync("put", "-e", endpoint, "--wait=10s", "/test", src); err != nil {
+		t.Fatalf("put --wait: %s", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(root, "a.conf")); err != nil || string(data) != "a = 1\n" {
+		t.Fatalf("a.conf is not applied: %q, %v", data, err)
+	}
+	// the tree is only published again with the signed manifest, no files change
+	if err := runConfsync("put", "-e", endpoint, "--sign-key", keyFile, "--wait=10s", "/test", src); err != nil {
+		t.Fatalf("put --sign-key --wait of the unchanged tree: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.conf")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherSettingsExcludeRuntimeState(t *testing.T) {
+	wc := &watcherConfig{name: "watcher /test", Prefix: "/test", Root: t.TempDir(), Command: []string{"true"}}
+	a, err := wc.newWatcher(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := wc.newWatcher(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.loadState()
+	b.pending, b.changes = newTreeUpdates(), newTreeChanges()
+	b.treeRevision = 5
+	b.reportStatus()
+	if !reflect.DeepEqual(a.settings(), b.settings()) {
+		t.Fatal("settings of the running watcher differ from the same definition")
+	}
+}